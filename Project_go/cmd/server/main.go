@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -8,12 +9,43 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"Project_go/internal"
 )
 
+// 設定ファイルのtemplatesに指定が無いときに使う、同梱のテンプレート
+var defaultTemplates = map[string]string{
+	"index":		"./Templates/index.html",
+	"folder":		"./Templates/folder.html",
+	"image":		"./Templates/image.html",
+	"imageR2L":		"./Templates/imageR2L.html",
+	"image360VR":	"./Templates/image360VR.html",
+	"movie":		"./Templates/movie.html",
+	"audio":		"./Templates/audio.html",
+	"playlist":		"./Templates/playlist.html",
+	"markdown":		"./Templates/markdown.html",
+}
+
+// parseTemplateは設定ファイルで指定されたテンプレートをパースします。
+// 指定が無いとき（新しく追加したテンプレートを書いていない古い設定ファイルなど）は、同梱のテンプレートを使います。
+func parseTemplate(config *internal.ServerConfig, name string) *template.Template {
+	filePath := config.Config.Templates[name]
+	if filePath == "" {
+		filePath = defaultTemplates[name]
+		log.Printf("%sテンプレートの指定が無いため、同梱のテンプレートを使います: '%s'", name, filePath)
+	}
+	tmpl, err := template.ParseFiles(filePath)
+	if err != nil {
+		log.Fatalf("%sテンプレートファイルのパースに失敗しました: %v", name, err)
+	}
+	return tmpl
+}
+
 func main() {
 	// settings.jsonを読み込みます。
 	filePath := "./settings.json"
@@ -27,37 +59,16 @@ func main() {
 		log.Fatalf("JSONのパースに失敗しました: %v", err)
 	}
 
-	// テンプレートファイルをパースします。
-	indexTmpl, err := template.ParseFiles(config.Config.Templates["index"])
-	if err != nil {
-		log.Fatalf("indexテンプレートファイルのパースに失敗しました: %v", err)
-	}
-	folderTmpl, err := template.ParseFiles(config.Config.Templates["folder"])
-	if err != nil {
-		log.Fatalf("folderテンプレートファイルのパースに失敗しました: %v", err)
-	}
-	imageTmpl, err := template.ParseFiles(config.Config.Templates["image"])
-	if err != nil {
-		log.Fatalf("imageテンプレートファイルのパースに失敗しました: %v", err)
-	}
-	imageR2LTmpl, err := template.ParseFiles(config.Config.Templates["imageR2L"])
-	if err != nil {
-		log.Fatalf("imageR2Lテンプレートファイルのパースに失敗しました: %v", err)
-	}
-	image360vrTmpl, err := template.ParseFiles(config.Config.Templates["image360VR"])
-	if err != nil {
-		log.Fatalf("image360VRテンプレートファイルのパースに失敗しました: %v", err)
-	}
-	// movieテンプレートを追加
-	movieTmpl, err := template.ParseFiles(config.Config.Templates["movie"])
-	if err != nil {
-		log.Fatalf("movieテンプレートファイルのパースに失敗しました: %v", err)
-	}
-	// markdownテンプレートを追加
-	markdownTmpl, err := template.ParseFiles(config.Config.Templates["markdown"])
-	if err != nil {
-		log.Fatalf("mdテンプレートファイルのパースに失敗しました: %v", err)
-	}
+	// テンプレートファイルをパースします。設定ファイルに無いものは同梱のテンプレートを使います。
+	indexTmpl := parseTemplate(&config, "index")
+	folderTmpl := parseTemplate(&config, "folder")
+	imageTmpl := parseTemplate(&config, "image")
+	imageR2LTmpl := parseTemplate(&config, "imageR2L")
+	image360vrTmpl := parseTemplate(&config, "image360VR")
+	movieTmpl := parseTemplate(&config, "movie")
+	audioTmpl := parseTemplate(&config, "audio")
+	playlistTmpl := parseTemplate(&config, "playlist")
+	markdownTmpl := parseTemplate(&config, "markdown")
 	err404Tmpl, err := template.ParseFiles("./templates/404.html")
 	if err != nil {
 		log.Fatalf("404テンプレートファイルのパースに失敗しました: %v", err)
@@ -66,8 +77,16 @@ func main() {
 	// サーバー起動時にフォルダパスを解決し、マップにキャッシュ
 	resolvedFolders := internal.ResolveFolders(config.Folders)
 
+	// Ctrl+CやSIGTERMで、バックグラウンドの変換を止めてからサーバーを終了する
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// 変換が必要な動画を前もって変換しておく（設定ファイルで有効なときだけ）
+	internal.StartPretranscode(ctx, resolvedFolders, &config)
+
 	// HTTPハンドラを設定します。
 	http.HandleFunc("/icon/", internal.HandleIconRequest(resolvedFolders, &config, err404Tmpl))
+	http.HandleFunc("/api/v1/", internal.HandleAPIRequest(resolvedFolders, &config))
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		requestedPath := getRequestedPath(r)
 
@@ -77,6 +96,18 @@ func main() {
 			return
 		}
 
+		// hls/で始まるリクエストはhls.goのハンドラにリダイレクト
+		if strings.HasPrefix(requestedPath, "hls/") {
+			internal.HandleHLSRequest(resolvedFolders, &config, err404Tmpl)(w, r)
+			return
+		}
+
+		// .thumbで終わるリクエストはthumbnail.goのハンドラにリダイレクト
+		if strings.HasSuffix(requestedPath, ".thumb") {
+			internal.HandleThumbnailRequest(resolvedFolders, &config, err404Tmpl)(w, r)
+			return
+		}
+
 		// .image.htmlで終わるリクエストはimage.goのハンドラにリダイレクト
 		if strings.HasSuffix(requestedPath, ".image.html") {
 			internal.HandleImageRequest(resolvedFolders, &config, imageTmpl, imageR2LTmpl, image360vrTmpl, err404Tmpl)(w, r)
@@ -89,15 +120,33 @@ func main() {
 			return
 		}
 		
+		// .subtitle.vttで終わるリクエストはsubtitle.goのハンドラにリダイレクト
+		if strings.HasSuffix(requestedPath, ".subtitle.vtt") {
+			internal.HandleSubtitleRequest(resolvedFolders, &config, err404Tmpl)(w, r)
+			return
+		}
+
 		// .htmlで終わらない動画ファイルへのリクエストはmovie.goのハンドラにリダイレクト
 		if !strings.HasSuffix(requestedPath, ".html") && internal.IsMovieFile(requestedPath) {
 			internal.HandleMovieStreaming(resolvedFolders, &config, err404Tmpl)(w, r)
 			return
 		}
 
-		// hls/で始まるリクエストはmovie.goのハンドラにリダイレクト（これは現在無い仕様のはず）
-		if strings.HasPrefix(requestedPath, "hls/") {
-			internal.HandleMovieStreaming(resolvedFolders, &config, err404Tmpl)(w, r)
+		// .audio.htmlで終わるリクエストはaudio.goのハンドラにリダイレクト
+		if strings.HasSuffix(requestedPath, ".audio.html") {
+			internal.HandleAudioPage(resolvedFolders, &config, audioTmpl, err404Tmpl)(w, r)
+			return
+		}
+
+		// .htmlで終わらない音声ファイルへのリクエストはaudio.goのハンドラにリダイレクト
+		if !strings.HasSuffix(requestedPath, ".html") && internal.IsAudioFile(requestedPath) {
+			internal.HandleAudioStreaming(resolvedFolders, &config, err404Tmpl)(w, r)
+			return
+		}
+
+		// .playlist.htmlで終わるリクエストはplaylist.goのハンドラにリダイレクト
+		if strings.HasSuffix(requestedPath, ".playlist.html") {
+			internal.HandlePlaylistPage(resolvedFolders, &config, playlistTmpl, err404Tmpl)(w, r)
 			return
 		}
 
@@ -121,7 +170,18 @@ func main() {
 	// Webサーバーを起動します。
 	port := fmt.Sprintf(":%d", config.Config.Server.Port)
 	fmt.Printf("Web Server Start (port:%s)...\n", port)
-	log.Fatal(http.ListenAndServe(port, nil))
+	server := &http.Server{Addr: port}
+	go func() {
+		<-ctx.Done()
+		log.Printf("サーバーを終了します")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+		server.Close()
+	}()
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 }
 
 // getRequestedPathはリクエストされたパスを正規化し、セキュリティ上の問題を回避します。
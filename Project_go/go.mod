@@ -6,6 +6,7 @@ toolchain go1.24.7
 
 require (
 	github.com/gomarkdown/markdown v0.0.0-20250810172220-2e2c11897d1a
-	github.com/google/uuid v1.6.0
 	golang.org/x/text v0.29.0
 )
+
+require golang.org/x/image v0.31.0
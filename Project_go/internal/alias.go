@@ -0,0 +1,389 @@
+// Functions/alias.go:エイリアス・ショートカットの解決:Functions/alias.go
+//
+// 公開フォルダーの中のエイリアスやショートカットは、リンク先が公開フォルダーの中にあればそこへリダイレクトする
+//	シンボリックリンク				POSIXのシンボリックリンク（フォルダーへのリンクはそのままフォルダーとして表示する）
+//	.lnk							Windowsのショートカット
+//	.url							インターネットショートカット（file://は公開フォルダーの中へ。http・httpsへはsymlinksがallow-allのときだけ）
+//	.desktop						freedesktopのリンク（Type=Link）
+//	macOSのエイリアス				Finderのエイリアス。macOSで ./Libraries/resolveAlias があるときだけ使う
+// どれもGoで読み取るので、プロセスを起動するのはmacOSのエイリアスの先頭のデータが見つかったときだけ
+//
+
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf16"
+)
+
+// macOSのエイリアスを解決する自作コマンド
+const resolveAliasCommand = "./Libraries/resolveAlias"
+
+// errNotAliasは、ファイルがエイリアスやショートカットではないことを表します。
+var errNotAlias = errors.New("エイリアスではありません")
+
+// aliasResolverはエイリアスやショートカットのリンク先を返すインターフェースです。
+type aliasResolver interface {
+	// resolveはリンク先の絶対パス、またはhttp・httpsのURLを返します。
+	// 扱わない種類のファイルのときはerrNotAliasを返します。
+	resolve(fullPath string) (string, error)
+}
+
+// aliasResolversは登録された順にリンク先の取得を試します。
+var aliasResolvers = []aliasResolver{
+	symlinkAlias{},
+	shellLinkAlias{},
+	internetShortcutAlias{},
+	desktopLinkAlias{},
+	macAlias{path: resolveAliasCommand},
+}
+
+// resolveAliasはエイリアスやショートカットのリンク先を返します。エイリアスでないときはerrNotAliasを返します。
+func resolveAlias(fullPath string) (string, error) {
+	for _, resolver := range aliasResolvers {
+		target, err := resolver.resolve(fullPath)
+		if errors.Is(err, errNotAlias) {
+			continue
+		}
+		return target, err
+	}
+	return "", errNotAlias
+}
+
+// isAliasURLは、リンク先がhttp・httpsのURLかどうかを返します。
+func isAliasURL(target string) bool {
+	return strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://")
+}
+
+// aliasRedirectはリンク先の絶対パスを、公開フォルダーのURLにします。
+// リンク先はシンボリックリンクをたどってから調べ、公開フォルダーの外やシンボリックリンクの設定で許されていないときはfalseを返します。
+func aliasRedirect(target string, resolvedFolders map[string]string, config *ServerConfig) (string, bool) {
+	realTarget := evalExistingSymlinks(target)
+	if linkPolicy(config) == linkPolicyDeny && realTarget != filepath.Clean(target) {
+		return "", false
+	}
+	for name, root := range resolvedFolders {
+		realRoot, err := filepath.EvalSymlinks(root)
+		if err != nil || !isWithinDir(realRoot, realTarget) {
+			continue
+		}
+		rel, _ := filepath.Rel(realRoot, realTarget)
+		link := "/" + url.PathEscape(name) + "/"
+		if rel == "." {
+			return link, true
+		}
+
+		// フォルダーは/を付けて、ファイルはビューアのページを開く
+		if info, err := os.Stat(realTarget); err == nil && info.IsDir() {
+			return link + escapeURLPath(filepath.ToSlash(rel)) + "/", true
+		}
+		if dir := filepath.Dir(rel); dir != "." {
+			link += escapeURLPath(filepath.ToSlash(dir)) + "/"
+		}
+		return link + getEntryPath(link, filepath.Base(realTarget), IsMovieFile(realTarget), isImageFile(realTarget)), true
+	}
+	return "", false
+}
+
+// fileURLPathはfile://のURLを、このOSのパスにします。
+func fileURLPath(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "file" {
+		return "", fmt.Errorf("file://のURLではありません: '%s'", rawURL)
+	}
+	p := u.Path
+	// file:///C:/Users/... のようなWindowsのパス
+	if runtime.GOOS == "windows" && len(p) > 2 && p[0] == '/' && p[2] == ':' {
+		p = p[1:]
+	}
+	return filepath.FromSlash(p), nil
+}
+
+// resolveLinkTargetは、ショートカットに書かれたリンク先を絶対パスかURLにします。
+// 相対パスはショートカットのあるフォルダーからの位置とみなします。
+func resolveLinkTarget(fullPath string, target string) (string, error) {
+	switch {
+	case target == "":
+		return "", fmt.Errorf("リンク先がありません: '%s'", fullPath)
+	case isAliasURL(target):
+		return target, nil
+	case strings.HasPrefix(target, "file:"):
+		return fileURLPath(target)
+	}
+	target = filepath.FromSlash(strings.ReplaceAll(target, `\`, "/"))
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(fullPath), target)
+	}
+	return filepath.Clean(target), nil
+}
+
+// symlinkAliasはシンボリックリンクのリンク先を返します。
+type symlinkAlias struct{}
+
+func (symlinkAlias) resolve(fullPath string) (string, error) {
+	info, err := os.Lstat(fullPath)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return "", errNotAlias
+	}
+	target, err := os.Readlink(fullPath)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(fullPath), target)
+	}
+	return filepath.Clean(target), nil
+}
+
+// shellLinkAliasはWindowsのショートカット（.lnk）のリンク先を返します。
+// [MS-SHLLINK]のLinkInfoのローカルパスか、StringDataの相対パスを使います。
+type shellLinkAlias struct{}
+
+// .lnkのヘッダーの値
+const (
+	shellLinkHeaderSize		= 0x4C
+	shellLinkHasIDList		= 0x01
+	shellLinkHasLinkInfo	= 0x02
+	shellLinkHasName		= 0x04
+	shellLinkHasRelPath		= 0x08
+	shellLinkIsUnicode		= 0x80
+	shellLinkLocalBasePath	= 0x01	// LinkInfoFlagsのVolumeIDAndLocalBasePath
+)
+
+func (shellLinkAlias) resolve(fullPath string) (string, error) {
+	if !strings.EqualFold(filepath.Ext(fullPath), ".lnk") {
+		return "", errNotAlias
+	}
+	data, err := readAliasFile(fullPath)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < shellLinkHeaderSize || binary.LittleEndian.Uint32(data) != shellLinkHeaderSize {
+		return "", fmt.Errorf("ショートカットの形式ではありません: '%s'", fullPath)
+	}
+	flags := binary.LittleEndian.Uint32(data[0x14:])
+	pos := shellLinkHeaderSize
+
+	// LinkTargetIDListは読み飛ばす
+	if flags&shellLinkHasIDList != 0 {
+		if len(data) < pos+2 {
+			return "", fmt.Errorf("ショートカットが壊れています: '%s'", fullPath)
+		}
+		pos += 2 + int(binary.LittleEndian.Uint16(data[pos:]))
+	}
+
+	// LinkInfoのローカルパス（LocalBasePath + CommonPathSuffix）
+	var localPath string
+	if flags&shellLinkHasLinkInfo != 0 {
+		if len(data) < pos+0x1C {
+			return "", fmt.Errorf("ショートカットが壊れています: '%s'", fullPath)
+		}
+		info := data[pos:]
+		size := int(binary.LittleEndian.Uint32(info))
+		if size < 0x1C || len(info) < size {
+			return "", fmt.Errorf("ショートカットが壊れています: '%s'", fullPath)
+		}
+		info = info[:size]
+		if binary.LittleEndian.Uint32(info[8:])&shellLinkLocalBasePath != 0 {
+			base := cString(info, int(binary.LittleEndian.Uint32(info[0x10:])))
+			suffix := cString(info, int(binary.LittleEndian.Uint32(info[0x18:])))
+			if base != "" {
+				localPath = strings.TrimSuffix(base, `\`)
+				if suffix != "" {
+					localPath += `\` + suffix
+				}
+			}
+		}
+		pos += size
+	}
+
+	// StringDataの相対パス（NAME_STRINGは読み飛ばす）
+	var relPath string
+	if flags&shellLinkHasName != 0 {
+		if _, pos, err = shellLinkString(data, pos, flags&shellLinkIsUnicode != 0); err != nil {
+			return "", fmt.Errorf("ショートカットが壊れています: '%s'", fullPath)
+		}
+	}
+	if flags&shellLinkHasRelPath != 0 {
+		if relPath, _, err = shellLinkString(data, pos, flags&shellLinkIsUnicode != 0); err != nil {
+			return "", fmt.Errorf("ショートカットが壊れています: '%s'", fullPath)
+		}
+	}
+
+	// 別のPCで作られたショートカットでも開けるように、相対パスを先に試す
+	// ローカルパス（C:\...）はWindowsのときだけ使う
+	useLocal := localPath != "" && runtime.GOOS == "windows"
+	if relPath != "" {
+		target, err := resolveLinkTarget(fullPath, relPath)
+		if err == nil {
+			if _, statErr := os.Stat(target); statErr == nil || !useLocal {
+				return target, nil
+			}
+		}
+	}
+	if useLocal {
+		return filepath.Clean(localPath), nil
+	}
+	return "", fmt.Errorf("ショートカットのリンク先が見つかりません: '%s'", fullPath)
+}
+
+// cStringはoffsetから始まる、0で終わる文字列を返します。
+func cString(data []byte, offset int) string {
+	if offset <= 0 || offset >= len(data) {
+		return ""
+	}
+	s := data[offset:]
+	if i := bytes.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return string(s)
+}
+
+// shellLinkStringは.lnkのStringDataの文字列を1つ読み、次の位置を返します。
+// 文字列が途中で切れているときはエラーを返します。
+func shellLinkString(data []byte, pos int, unicode bool) (string, int, error) {
+	if pos < 0 || len(data) < pos+2 {
+		return "", len(data), io.ErrUnexpectedEOF
+	}
+	count := int(binary.LittleEndian.Uint16(data[pos:]))
+	pos += 2
+	size := count
+	if unicode {
+		size = count * 2
+	}
+	if len(data) < pos+size {
+		return "", len(data), io.ErrUnexpectedEOF
+	}
+	if !unicode {
+		return string(data[pos : pos+size]), pos + size, nil
+	}
+	chars := make([]uint16, count)
+	for i := range chars {
+		chars[i] = binary.LittleEndian.Uint16(data[pos+i*2:])
+	}
+	return string(utf16.Decode(chars)), pos + size, nil
+}
+
+// internetShortcutAliasはインターネットショートカット（.url）のリンク先を返します。
+type internetShortcutAlias struct{}
+
+func (internetShortcutAlias) resolve(fullPath string) (string, error) {
+	if !strings.EqualFold(filepath.Ext(fullPath), ".url") {
+		return "", errNotAlias
+	}
+	values, err := readIniSection(fullPath, "InternetShortcut")
+	if err != nil {
+		return "", err
+	}
+	return resolveLinkTarget(fullPath, values["URL"])
+}
+
+// desktopLinkAliasはfreedesktopの.desktopファイルのうち、Type=Linkのもののリンク先を返します。
+// アプリケーションの起動用（Type=Application）はエイリアスとして扱いません。
+type desktopLinkAlias struct{}
+
+func (desktopLinkAlias) resolve(fullPath string) (string, error) {
+	if filepath.Ext(fullPath) != ".desktop" {
+		return "", errNotAlias
+	}
+	values, err := readIniSection(fullPath, "Desktop Entry")
+	if err != nil {
+		return "", err
+	}
+	if values["Type"] != "Link" {
+		return "", errNotAlias
+	}
+	return resolveLinkTarget(fullPath, values["URL"])
+}
+
+// macAliasはmacOSのFinderのエイリアスのリンク先を、自作コマンドで返します。
+// エイリアスのデータ（"book"で始まるブックマーク）のときだけコマンドを起動します。
+type macAlias struct {
+	path	string
+}
+
+func (m macAlias) resolve(fullPath string) (string, error) {
+	if runtime.GOOS != "darwin" {
+		return "", errNotAlias
+	}
+	header := make([]byte, 16)
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return "", errNotAlias
+	}
+	_, err = io.ReadFull(file, header)
+	file.Close()
+	if err != nil || !bytes.HasPrefix(header, []byte("book")) || !bytes.Equal(header[8:12], []byte("mark")) {
+		return "", errNotAlias
+	}
+
+	cmd := exec.Command(m.path, fullPath)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("Error: %s", strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(out.String()), nil
+}
+
+// ショートカットは小さいので、大きなファイルは読まない
+const aliasMaxSize = 64 * 1024
+
+// readAliasFileはショートカットのファイルを読み込みます。
+func readAliasFile(fullPath string) ([]byte, error) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, aliasMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > aliasMaxSize {
+		return nil, fmt.Errorf("ショートカットとしては大きすぎます: '%s'", fullPath)
+	}
+	return data, nil
+}
+
+// readIniSectionはINI形式のファイル（.url・.desktop）から、1つのセクションのキーと値を読み込みます。
+func readIniSection(fullPath string, section string) (map[string]string, error) {
+	data, err := readAliasFile(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	inSection := false
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inSection = line[1:len(line)-1] == section
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok && inSection {
+			if _, exists := values[strings.TrimSpace(key)]; !exists {
+				values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+			}
+		}
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("[%s]がありません: '%s'", section, fullPath)
+	}
+	return values, nil
+}
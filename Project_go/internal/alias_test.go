@@ -0,0 +1,214 @@
+// Functions/alias_test.go:エイリアス・ショートカットの解決のテスト:Functions/alias_test.go
+//
+// .lnk・.url・.desktopのファイルを作って、リンク先を読み取れることを調べる
+// 途中で切れたファイルや、範囲外を指すオフセットの壊れたファイルでも、パニックせずにエラーになることを確かめる
+//
+
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"unicode/utf16"
+)
+
+// shellLinkは.lnkのヘッダーに、続くデータを付けて返します。
+func shellLink(flags uint32, parts ...[]byte) []byte {
+	header := make([]byte, shellLinkHeaderSize)
+	binary.LittleEndian.PutUint32(header, shellLinkHeaderSize)
+	binary.LittleEndian.PutUint32(header[0x14:], flags)
+	return append(header, bytes.Join(parts, nil)...)
+}
+
+// shellLinkIDListは中身がnバイトのLinkTargetIDListを返します。
+func shellLinkIDList(n int) []byte {
+	data := make([]byte, 2+n)
+	binary.LittleEndian.PutUint16(data, uint16(n))
+	return data
+}
+
+// shellLinkInfoはローカルパス（LocalBasePath + CommonPathSuffix）だけのLinkInfoを返します。
+func shellLinkInfo(base string, suffix string) []byte {
+	data := make([]byte, 0x1C)
+	data = append(data, base+"\x00"+suffix+"\x00"...)
+	binary.LittleEndian.PutUint32(data, uint32(len(data)))
+	binary.LittleEndian.PutUint32(data[4:], 0x1C)
+	binary.LittleEndian.PutUint32(data[8:], shellLinkLocalBasePath)
+	binary.LittleEndian.PutUint32(data[0x10:], 0x1C)
+	binary.LittleEndian.PutUint32(data[0x18:], uint32(0x1C+len(base)+1))
+	return data
+}
+
+// shellLinkUnicodeはStringDataのUTF-16の文字列を返します。
+func shellLinkUnicode(s string) []byte {
+	chars := utf16.Encode([]rune(s))
+	data := binary.LittleEndian.AppendUint16(nil, uint16(len(chars)))
+	for _, c := range chars {
+		data = binary.LittleEndian.AppendUint16(data, c)
+	}
+	return data
+}
+
+// shellLinkANSIはStringDataのANSIの文字列を返します。
+func shellLinkANSI(s string) []byte {
+	return append(binary.LittleEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+func TestResolveAlias(t *testing.T) {
+	dir := t.TempDir()
+	relPath := shellLink(shellLinkHasRelPath|shellLinkIsUnicode, shellLinkUnicode(`..\photos\ページ2.jpg`))
+	localOnly := shellLink(shellLinkHasLinkInfo, shellLinkInfo(`C:\photos\`, `page2.jpg`))
+
+	// LinkInfoの大きさを、ファイルより大きくする
+	infoTooLarge := shellLink(shellLinkHasLinkInfo, shellLinkInfo(`C:\photos`, `page2.jpg`))
+	binary.LittleEndian.PutUint32(infoTooLarge[shellLinkHeaderSize:], 0xFFFF)
+	// LinkInfoの大きさを、ヘッダーより小さくする
+	infoTooSmall := shellLink(shellLinkHasLinkInfo, shellLinkInfo(`C:\photos`, `page2.jpg`))
+	binary.LittleEndian.PutUint32(infoTooSmall[shellLinkHeaderSize:], 4)
+	// LocalBasePathとCommonPathSuffixの位置を、LinkInfoの外にする
+	offsetsOut := shellLink(shellLinkHasLinkInfo, shellLinkInfo(`C:\photos`, `page2.jpg`))
+	binary.LittleEndian.PutUint32(offsetsOut[shellLinkHeaderSize+0x10:], 0xFFFFFFFF)
+	binary.LittleEndian.PutUint32(offsetsOut[shellLinkHeaderSize+0x18:], 0x7FFFFFFF)
+	// StringDataの文字数を、残りのデータより多くする
+	stringCut := shellLink(shellLinkHasRelPath|shellLinkIsUnicode, shellLinkUnicode(`..\photos\page2.jpg`))
+	binary.LittleEndian.PutUint16(stringCut[shellLinkHeaderSize:], 200)
+
+	localWant, localErr := filepath.Clean(`C:\photos\page2.jpg`), runtime.GOOS != "windows"
+	if localErr {
+		localWant = ""
+	}
+
+	tests := []struct {
+		name		string
+		file		string
+		data		[]byte
+		want		string
+		wantErr		bool
+	}{
+		// .lnk
+		{"lnk 相対パス", "a.lnk", relPath, filepath.Join(dir, "..", "photos", "ページ2.jpg"), false},
+		{"lnk ANSIの名前と相対パス", "b.lnk", shellLink(shellLinkHasName|shellLinkHasRelPath, shellLinkANSI("name"), shellLinkANSI(`album\p1.jpg`)), filepath.Join(dir, "album", "p1.jpg"), false},
+		{"lnk IDListとLinkInfoを読み飛ばす", "c.lnk", shellLink(shellLinkHasIDList|shellLinkHasLinkInfo|shellLinkHasRelPath|shellLinkIsUnicode, shellLinkIDList(20), shellLinkInfo(`C:\photos`, ""), shellLinkUnicode("p1.jpg")), filepath.Join(dir, "p1.jpg"), false},
+		{"lnk ローカルパスだけ", "d.lnk", localOnly, localWant, localErr},
+		{"lnk 大文字の拡張子", "E.LNK", relPath, filepath.Join(dir, "..", "photos", "ページ2.jpg"), false},
+		{"lnk 空", "empty.lnk", nil, "", true},
+		{"lnk ヘッダーの途中で切れる", "short.lnk", relPath[:0x20], "", true},
+		{"lnk ヘッダーの大きさが違う", "header.lnk", append([]byte{0x4D}, relPath[1:]...), "", true},
+		{"lnk リンク先が無い", "none.lnk", shellLink(0), "", true},
+		{"lnk IDListの途中で切れる", "idcut.lnk", shellLink(shellLinkHasIDList|shellLinkHasRelPath, []byte{0x10}), "", true},
+		{"lnk IDListの大きさがファイルより大きい", "idlist.lnk", shellLink(shellLinkHasIDList|shellLinkHasLinkInfo, []byte{0xFF, 0xFF}, shellLinkInfo(`C:\photos`, "")), "", true},
+		{"lnk IDListの後の文字列が無い", "idstr.lnk", shellLink(shellLinkHasIDList|shellLinkHasRelPath, []byte{0xFF, 0xFF}), "", true},
+		{"lnk LinkInfoの途中で切れる", "infocut.lnk", localOnly[:shellLinkHeaderSize+0x10], "", true},
+		{"lnk LinkInfoの大きさがファイルより大きい", "infolarge.lnk", infoTooLarge, "", true},
+		{"lnk LinkInfoの大きさが小さすぎる", "infosmall.lnk", infoTooSmall, "", true},
+		{"lnk ローカルパスの位置が範囲外", "offsets.lnk", offsetsOut, "", true},
+		{"lnk 文字列の途中で切れる", "strcut.lnk", stringCut, "", true},
+		{"lnk 文字列の長さの途中で切れる", "lencut.lnk", shellLink(shellLinkHasName|shellLinkHasRelPath, []byte{0x05}), "", true},
+		{"lnk 大きすぎる", "large.lnk", append(relPath, make([]byte, aliasMaxSize)...), "", true},
+
+		// .url
+		{"url http", "web.url", []byte("[InternetShortcut]\r\nURL=https://example.com/x\r\n"), "https://example.com/x", false},
+		{"url file", "file.url", []byte("\xef\xbb\xbf[InternetShortcut]\nURL=file:///srv/photos/album/\n"), filepath.FromSlash("/srv/photos/album/"), false},
+		{"url 相対パス", "rel.url", []byte("; comment\n[InternetShortcut]\nURL = album/p1.jpg\nURL=other\n"), filepath.Join(dir, "album", "p1.jpg"), false},
+		{"url 別のセクションだけ", "section.url", []byte("[Other]\nURL=https://example.com/\n"), "", true},
+		{"url URLが無い", "nourl.url", []byte("[InternetShortcut]\nIconIndex=0\n"), "", true},
+		{"url バイナリー", "binary.url", relPath, "", true},
+
+		// .desktop
+		{"desktop Link", "link.desktop", []byte("[Desktop Entry]\nType=Link\nName=x\nURL=manga/p2.jpg\n"), filepath.Join(dir, "manga", "p2.jpg"), false},
+		{"desktop 別のセクションのURLは見ない", "action.desktop", []byte("[Desktop Action x]\nURL=/etc\n[Desktop Entry]\nType=Link\nURL=p1.jpg\n"), filepath.Join(dir, "p1.jpg"), false},
+		{"desktop URLが無い", "nourl.desktop", []byte("[Desktop Entry]\nType=Link\n"), "", true},
+		{"desktop セクションが無い", "empty.desktop", []byte("Type=Link\nURL=p1.jpg\n"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fullPath := filepath.Join(dir, tt.file)
+			if err := os.WriteFile(fullPath, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := resolveAlias(fullPath)
+			if (err != nil) != tt.wantErr || errors.Is(err, errNotAlias) || got != tt.want {
+				t.Errorf("resolveAlias = %q, %v, want %q (error %v)", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResolveAliasNotAlias(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		file	string
+		data	string
+	}{
+		{"app.desktop", "[Desktop Entry]\nType=Application\nExec=ls\n"},
+		{"page.txt", "[InternetShortcut]\nURL=https://example.com/\n"},
+		{"link.DESKTOP", "[Desktop Entry]\nType=Link\nURL=p1.jpg\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			fullPath := filepath.Join(dir, tt.file)
+			if err := os.WriteFile(fullPath, []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := resolveAlias(fullPath); !errors.Is(err, errNotAlias) {
+				t.Errorf("resolveAlias = %q, %v, want errNotAlias", got, err)
+			}
+		})
+	}
+}
+
+func TestCString(t *testing.T) {
+	data := []byte("\x00abc\x00def")
+	tests := []struct {
+		offset	int
+		want	string
+	}{
+		{1, "abc"},
+		{5, "def"},	// 0で終わっていない
+		{4, ""},
+		{0, ""},
+		{-1, ""},
+		{len(data), ""},
+		{1 << 30, ""},
+	}
+	for _, tt := range tests {
+		if got := cString(data, tt.offset); got != tt.want {
+			t.Errorf("cString(%d) = %q, want %q", tt.offset, got, tt.want)
+		}
+	}
+}
+
+func TestShellLinkString(t *testing.T) {
+	unicode := shellLinkUnicode("写真.jpg")
+	tests := []struct {
+		name		string
+		data		[]byte
+		pos			int
+		unicode		bool
+		want		string
+		wantNext	int
+		wantErr		bool
+	}{
+		{"UTF-16", unicode, 0, true, "写真.jpg", len(unicode), false},
+		{"ANSI", append(shellLinkANSI("abc"), "rest"...), 0, false, "abc", 5, false},
+		{"空の文字列", []byte{0, 0}, 0, true, "", 2, false},
+		{"UTF-16の途中で切れる", unicode[:len(unicode)-1], 0, true, "", 0, true},
+		{"ANSIの途中で切れる", shellLinkANSI("abc")[:4], 0, false, "", 0, true},
+		{"長さの途中で切れる", []byte{0x03}, 0, false, "", 0, true},
+		{"位置が範囲外", unicode, len(unicode) + 10, true, "", 0, true},
+		{"位置が負", unicode, -1, true, "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, next, err := shellLinkString(tt.data, tt.pos, tt.unicode)
+			if (err != nil) != tt.wantErr || got != tt.want || (!tt.wantErr && next != tt.wantNext) {
+				t.Errorf("shellLinkString = %q, %d, %v, want %q, %d (error %v)", got, next, err, tt.want, tt.wantNext, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+// Functions/api.go:JSON APIハンドラ:Functions/api.go
+//
+// HTMLページと同じ内容をJSONで返す
+//	/api/v1/					ルートフォルダーの一覧
+//	/api/v1/list/<パス>			フォルダーの内容（FolderData）、アーカイブの中も可
+//	/api/v1/image/<パス>		画像ビューアのデータ（ImageData）
+//	/api/v1/markdown/<パス>		HTML化したMarkdown（MarkdownData）
+//	/api/v1/movie/<パス>		動画再生ページのデータ（VideoTemplateData）
+//	/api/v1/audio/<パス>		音声プレイヤーのデータ（AudioTemplateData）
+//	/api/v1/playlist/<パス>		プレイリストのデータ（PlaylistTemplateData）
+//	/api/v1/info/<パス>			ファイルのメタデータ（FileInfoData）
+//	/api/v1/progress/<パス>		再生位置（progress.go）
+//	/api/v1/bookmark/<パス>		画像ビューアのしおり（bookmark.go）
+//
+// レスポンスに含まれるリンクは、対応するHTMLページのURLを基準にしている
+//
+
+package internal
+
+import (
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// APIのURLの接頭辞
+const apiPrefix = "/api/v1/"
+
+// apiErrorはエラーのときに返すJSONを定義します。
+type apiError struct {
+	Error	string	`json:"error"`
+}
+
+// HandleAPIRequestは/api/v1/以下のリクエストを処理してJSONを返します。
+func HandleAPIRequest(resolvedFolders map[string]string, config *ServerConfig) http.HandlerFunc {
+	paths := newPathResolver(resolvedFolders, config)
+	return func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.TrimPrefix(r.URL.Path, apiPrefix)
+		kind, rest, _ := strings.Cut(rest, "/")
+		requestedPath := cleanAPIPath(rest)
+
+		// ルートフォルダーの一覧
+		if kind == "" || (kind == "list" && requestedPath == "") {
+			log.Printf("API: ルートパスがリクエストされました")
+			writeJSON(w, http.StatusOK, buildRootData(resolvedFolders))
+			return
+		}
+
+		// 再生位置
+		if kind == "progress" {
+			handleProgressAPI(w, r, paths, requestedPath, config)
+			return
+		}
+
+		// 画像ビューアのしおり
+		if kind == "bookmark" {
+			handleBookmarkAPI(w, r, paths, requestedPath, config)
+			return
+		}
+
+		target, ok := paths.resolve(requestedPath)
+		if !ok {
+			log.Printf("API: 許可されたルートフォルダ以外のパス: '%s'", requestedPath)
+			writeJSONError(w, http.StatusNotFound, "not found")
+			return
+		}
+		fullPath, info := target.fullPath, target.info
+		if target.kind == pathInArchive && (kind == "list" || kind == "image") {
+			// アーカイブの中のパス
+			handleArchiveAPI(w, r, kind, requestedPath, target.archivePath, target.inner, config)
+			return
+		}
+		if info == nil {
+			log.Printf("API: 404: '%s'", fullPath)
+			writeJSONError(w, http.StatusNotFound, "not found")
+			return
+		}
+
+		switch kind {
+		case "list":
+			if info.Mode().IsRegular() && isBrowsableArchive(fullPath) {
+				handleArchiveAPI(w, r, kind, requestedPath, fullPath, "", config)
+				return
+			}
+			if !info.IsDir() {
+				writeJSONError(w, http.StatusBadRequest, "not a folder")
+				return
+			}
+			data, err := buildFolderData(htmlRequest(r, "/"+requestedPath+"/"), fullPath, config)
+			if err != nil {
+				log.Printf("API: フォルダの読み込みに失敗しました: '%s' %v", fullPath, err)
+				writeJSONError(w, http.StatusInternalServerError, "failed to read folder")
+				return
+			}
+			writeJSON(w, http.StatusOK, data)
+
+		case "image":
+			if !info.Mode().IsRegular() || !isImageFile(fullPath) {
+				writeJSONError(w, http.StatusBadRequest, "not an image")
+				return
+			}
+			data, err := buildImageData(htmlRequest(r, "/"+requestedPath+".image.html"), fullPath, config)
+			if err != nil {
+				log.Printf("API: フォルダの読み込みに失敗しました: '%s' %v", fullPath, err)
+				writeJSONError(w, http.StatusInternalServerError, "failed to read folder")
+				return
+			}
+			writeJSON(w, http.StatusOK, data)
+
+		case "markdown":
+			if !info.Mode().IsRegular() {
+				writeJSONError(w, http.StatusBadRequest, "not a file")
+				return
+			}
+			data, err := buildMarkdownData(htmlRequest(r, "/"+requestedPath), fullPath)
+			if err != nil {
+				log.Printf("API: ファイルの読み込みに失敗しました: '%s' %v", fullPath, err)
+				writeJSONError(w, http.StatusInternalServerError, "failed to read file")
+				return
+			}
+			writeJSON(w, http.StatusOK, data)
+
+		case "movie":
+			if !info.Mode().IsRegular() || !IsMovieFile(fullPath) {
+				writeJSONError(w, http.StatusBadRequest, "not a movie")
+				return
+			}
+			writeJSON(w, http.StatusOK, buildMovieData(w, htmlRequest(r, "/"+requestedPath+".movie.html"), requestedPath, paths, config))
+
+		case "audio":
+			if !info.Mode().IsRegular() || !IsAudioFile(fullPath) {
+				writeJSONError(w, http.StatusBadRequest, "not an audio file")
+				return
+			}
+			data, err := buildAudioData(htmlRequest(r, "/"+requestedPath+".audio.html"), fullPath, config)
+			if err != nil {
+				log.Printf("API: フォルダの読み込みに失敗しました: '%s' %v", fullPath, err)
+				writeJSONError(w, http.StatusInternalServerError, "failed to read folder")
+				return
+			}
+			writeJSON(w, http.StatusOK, data)
+
+		case "playlist":
+			if !info.Mode().IsRegular() || !isPlaylistFile(fullPath) {
+				writeJSONError(w, http.StatusBadRequest, "not a playlist")
+				return
+			}
+			data, err := buildPlaylistData(htmlRequest(r, "/"+requestedPath+".playlist.html"), requestedPath, fullPath, paths)
+			if err != nil {
+				log.Printf("API: ファイルの読み込みに失敗しました: '%s' %v", fullPath, err)
+				writeJSONError(w, http.StatusInternalServerError, "failed to read file")
+				return
+			}
+			writeJSON(w, http.StatusOK, data)
+
+		case "info":
+			writeJSON(w, http.StatusOK, buildFileInfoData(requestedPath, fullPath, info))
+
+		default:
+			writeJSONError(w, http.StatusNotFound, "unknown endpoint")
+		}
+	}
+}
+
+// handleArchiveAPIはアーカイブの中のフォルダーの一覧と画像ビューアのデータを返します。
+func handleArchiveAPI(w http.ResponseWriter, r *http.Request, kind string, requestedPath string, archivePath string, inner string, config *ServerConfig) {
+	if kind == "image" {
+		data, err := buildArchiveImageData(htmlRequest(r, "/"+requestedPath+".image.html"), archivePath, inner, config)
+		if err != nil {
+			log.Printf("API: アーカイブ内の画像を表示できません: '%s' の '%s' %v", archivePath, inner, err)
+			writeJSONError(w, http.StatusNotFound, "not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, data)
+		return
+	}
+
+	archive, err := openVirtualArchive(archivePath)
+	if err != nil {
+		log.Printf("API: %v: '%s'", err, archivePath)
+		writeJSONError(w, http.StatusInternalServerError, "failed to read archive")
+		return
+	}
+	defer archive.Close()
+	if entry, ok := archive.stat(inner); !ok || !entry.isDir {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, buildArchiveFolderData(htmlRequest(r, "/"+requestedPath+"/"), archive, archivePath, inner, config))
+}
+
+// cleanAPIPathはAPIのURLに含まれるパスを、getRequestedPathと同じ形式に正規化します。
+func cleanAPIPath(path string) string {
+	path, _ = url.PathUnescape(path)
+	path = filepath.Clean("/" + path)
+	return strings.TrimPrefix(path, "/")
+}
+
+// htmlRequestは、対応するHTMLページへのリクエストに見えるように、URLのパスを差し替えたリクエストを返します。
+// データを組み立てる関数がr.URL.Pathを基準にリンクを作るので、HTMLと同じリンクになります。
+func htmlRequest(r *http.Request, path string) *http.Request {
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = path
+	r2.URL.RawPath = ""
+	return r2
+}
+
+// buildFileInfoDataはファイルのメタデータを組み立てます。
+func buildFileInfoData(requestedPath string, fullPath string, info os.FileInfo) FileInfoData {
+	data := FileInfoData{
+		WS_Name:		info.Name(),
+		WS_Link:		"/" + requestedPath,
+		WS_Size:		info.Size(),
+		WS_LastMod:		info.ModTime().Format("2006-01-02 15:04:05"),
+		WS_IsDirectory:	info.IsDir(),
+	}
+	if info.IsDir() {
+		data.WS_Link += "/"
+		return data
+	}
+	data.WS_MimeType = mime.TypeByExtension(filepath.Ext(fullPath))
+	data.WS_IsMovie = IsMovieFile(fullPath)
+	data.WS_IsAudio = IsAudioFile(fullPath)
+	data.WS_IsImage = isImageFile(fullPath)
+	if data.WS_IsImage {
+		if width, height, err := imageDimensions(fullPath); err == nil {
+			data.WS_Width, data.WS_Height = width, height
+		}
+	}
+	return data
+}
+
+// writeJSONはvをJSONにしてレスポンスに書き込みます。
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		log.Printf("API: JSONの書き込みに失敗しました: %v", err)
+	}
+}
+
+// writeJSONErrorはエラーメッセージをJSONで返します。
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, apiError{Error: message})
+}
@@ -0,0 +1,219 @@
+// Functions/archive.go:フォルダーのダウンロード:Functions/archive.go
+//
+// folder/?download=zip|tar|tar.gz でフォルダーをアーカイブにしてダウンロードする
+// アーカイブは一時ファイルを作らずに、そのままレスポンスに書き出す
+// ?select=名前 を複数付けると、そのフォルダー直下の指定した項目だけをまとめる
+//
+
+package internal
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// archiveWriterはzipとtarの書き込みを同じように扱うためのインターフェースです。
+type archiveWriter interface {
+	addFile(name string, f *os.File, info fs.FileInfo) error	// fは開いてから渡すので、読めないファイルで途中までのヘッダーが残らない
+	addDir(name string, info fs.FileInfo) error
+	Close() error
+}
+
+// isArchiveFormatはダウンロードできるアーカイブ形式かどうかを返します。
+func isArchiveFormat(format string) bool {
+	return format == "zip" || format == "tar" || format == "tar.gz"
+}
+
+// handleFolderDownloadはフォルダーをアーカイブにして送信します。
+func handleFolderDownload(w http.ResponseWriter, r *http.Request, fullPath string, format string, config *ServerConfig) {
+	// 選択された項目を確認（指定が無いときはフォルダー全体）
+	var targets []string
+	for _, name := range r.URL.Query()["select"] {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if ignored, _ := isIgnored(name, config.Ignores); ignored {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if _, err := os.Lstat(filepath.Join(fullPath, name)); err != nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		targets = append(targets, name)
+	}
+	if len(targets) == 0 {
+		entries, err := os.ReadDir(fullPath)
+		if err != nil {
+			log.Printf("Archive: フォルダの読み込みに失敗しました: '%s' %v", fullPath, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		for _, entry := range entries {
+			targets = append(targets, entry.Name())
+		}
+	}
+
+	fileName := filepath.Base(fullPath) + "." + format
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename*=UTF-8''%s`, url.PathEscape(fileName)))
+	w.Header().Set("Cache-Control", "no-cache")
+
+	var archive archiveWriter
+	switch format {
+	case "zip":
+		w.Header().Set("Content-Type", "application/zip")
+		archive = &zipArchive{zip.NewWriter(w)}
+	case "tar":
+		w.Header().Set("Content-Type", "application/x-tar")
+		archive = &tarArchive{tw: tar.NewWriter(w)}
+	case "tar.gz":
+		w.Header().Set("Content-Type", "application/gzip")
+		gz := gzip.NewWriter(w)
+		archive = &tarArchive{tw: tar.NewWriter(gz), gz: gz}
+	}
+
+	log.Printf("Archive: フォルダーのダウンロード開始: '%s' (%s)", fullPath, format)
+	for _, name := range targets {
+		if err := addToArchive(archive, fullPath, name, config); err != nil {
+			// 途中まで送信しているのでステータスは変えられない。ログだけ残して打ち切る
+			log.Printf("Archive: アーカイブの作成に失敗しました: '%s' %v", fullPath, err)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("Archive: アーカイブの終了に失敗しました: '%s' %v", fullPath, err)
+		return
+	}
+	log.Printf("Archive: フォルダーのダウンロード完了: '%s'", fullPath)
+}
+
+// addToArchiveはbaseDir直下のnameを、フォルダーなら中身ごとアーカイブに追加します。
+// ignoresや隠しファイルに一致するものと、通常のファイル・フォルダー以外（シンボリックリンクなど）は含めません。
+// 読み込めないフォルダーやファイルもログを残して飛ばすので、エラーを返すのはアーカイブに書き込めないときだけです。
+func addToArchive(archive archiveWriter, baseDir string, name string, config *ServerConfig) error {
+	return filepath.WalkDir(filepath.Join(baseDir, name), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("Archive: 読み込めないため除外: '%s' %v", path, err)
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if ignored, reason := isIgnored(d.Name(), config.Ignores); ignored {
+			log.Printf("Archive: 除外パス: '%s' (Reason: %s)", path, reason)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(baseDir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		info, err := d.Info()
+		if err != nil {
+			log.Printf("Archive: 読み込めないため除外: '%s' %v", path, err)
+			return nil
+		}
+
+		switch {
+		case d.IsDir():
+			return archive.addDir(rel+"/", info)
+		case info.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				log.Printf("Archive: 読み込めないため除外: '%s' %v", path, err)
+				return nil
+			}
+			defer f.Close()
+			return archive.addFile(rel, f, info)
+		}
+		return nil
+	})
+}
+
+// zipArchiveはzip形式のarchiveWriterです。
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (a *zipArchive) addDir(name string, info fs.FileInfo) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	_, err = a.CreateHeader(header)
+	return err
+}
+
+func (a *zipArchive) addFile(name string, f *os.File, info fs.FileInfo) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	// 画像や動画はすでに圧縮されているので、無駄に圧縮しない
+	if isImageFile(f.Name()) || IsMovieFile(f.Name()) {
+		header.Method = zip.Store
+	} else {
+		header.Method = zip.Deflate
+	}
+	writer, err := a.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, f)
+	return err
+}
+
+// tarArchiveはtar形式（gzip圧縮あり・なし）のarchiveWriterです。
+type tarArchive struct {
+	tw	*tar.Writer
+	gz	*gzip.Writer	// tar.gzのときだけ
+}
+
+func (a *tarArchive) addDir(name string, info fs.FileInfo) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	return a.tw.WriteHeader(header)
+}
+
+func (a *tarArchive) addFile(name string, f *os.File, info fs.FileInfo) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := a.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(a.tw, f)
+	return err
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	if a.gz != nil {
+		return a.gz.Close()
+	}
+	return nil
+}
@@ -0,0 +1,495 @@
+// Functions/archivefs.go:アーカイブの仮想フォルダー:Functions/archivefs.go
+//
+// ZIP/CBZ/TAR/CBTファイルを、展開せずにフォルダーと同じようにブラウズできるようにする
+//	book.cbz			アーカイブ自体のダウンロード
+//	book.cbz/			アーカイブの中身の一覧
+//	book.cbz/a/1.jpg	アーカイブの中のファイル
+//	book.cbz/1.jpg.image.html	アーカイブの中の画像を画像ビューアで表示
+//
+
+package internal
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// フォルダーとしてブラウズできるアーカイブの拡張子と形式
+var browsableArchiveExts = map[string]string{
+	".zip":	"zip",
+	".cbz":	"zip",
+	".tar":	"tar",
+	".cbt":	"tar",
+}
+
+// isBrowsableArchiveはフォルダーとしてブラウズできるアーカイブかどうかを返します。
+func isBrowsableArchive(filePath string) bool {
+	_, ok := browsableArchiveExts[strings.ToLower(filepath.Ext(filePath))]
+	return ok
+}
+
+// findArchivePathはパスの途中にあるアーカイブファイルを探し、アーカイブのパスと中のパスに分けます。
+// 中のパスは/区切りで、アーカイブのルートのときは空文字になります。
+func findArchivePath(fullPath string) (string, string, bool) {
+	for p := fullPath; ; p = filepath.Dir(p) {
+		if isBrowsableArchive(p) {
+			if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() {
+				inner, err := filepath.Rel(p, fullPath)
+				if err != nil {
+					return "", "", false
+				}
+				if inner == "." {
+					inner = ""
+				}
+				return p, filepath.ToSlash(inner), true
+			}
+		}
+		if p == filepath.Dir(p) {
+			return "", "", false
+		}
+	}
+}
+
+// archiveEntryはアーカイブの中の1つの項目です。
+type archiveEntry struct {
+	name	string	// アーカイブ内のパス（/区切り、末尾の/なし）
+	isDir	bool
+	size	int64
+	modTime	time.Time
+
+	zipFile		*zip.File	// ZIPのとき
+	tarOffset	int64		// TARのとき、データの開始位置
+}
+
+// virtualArchiveは開いたアーカイブの目次です。
+type virtualArchive struct {
+	file	*os.File
+	entries	map[string]*archiveEntry
+}
+
+// openVirtualArchiveはアーカイブを開いて目次を作ります。使い終わったらCloseすること。
+func openVirtualArchive(archivePath string) (*virtualArchive, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("アーカイブのオープンに失敗しました: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("アーカイブの情報取得に失敗しました: %w", err)
+	}
+
+	a := &virtualArchive{
+		file:		f,
+		entries:	map[string]*archiveEntry{"": {name: "", isDir: true, modTime: info.ModTime()}},
+	}
+	switch browsableArchiveExts[strings.ToLower(filepath.Ext(archivePath))] {
+	case "zip":
+		err = a.readZip(info.Size())
+	case "tar":
+		err = a.readTar()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// readZipはZIPの目次を読み込みます。
+func (a *virtualArchive) readZip(size int64) error {
+	zr, err := zip.NewReader(a.file, size)
+	if err != nil {
+		return fmt.Errorf("ZIPの読み込みに失敗しました: %w", err)
+	}
+	for _, zf := range zr.File {
+		name := cleanArchiveName(zf.Name)
+		if name == "" {
+			continue
+		}
+		if strings.HasSuffix(zf.Name, "/") || zf.FileInfo().IsDir() {
+			a.addDir(name, zf.Modified)
+			continue
+		}
+		a.addEntry(&archiveEntry{name: name, size: int64(zf.UncompressedSize64), modTime: zf.Modified, zipFile: zf})
+	}
+	return nil
+}
+
+// readTarはTARの目次を読み込みます。データは読み飛ばし、開始位置だけを記録します。
+func (a *virtualArchive) readTar() error {
+	pr := &positionReader{file: a.file}
+	tr := tar.NewReader(pr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("TARの読み込みに失敗しました: %w", err)
+		}
+		name := cleanArchiveName(header.Name)
+		if name == "" {
+			continue
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			a.addDir(name, header.ModTime)
+		case tar.TypeReg:
+			a.addEntry(&archiveEntry{name: name, size: header.Size, modTime: header.ModTime, tarOffset: pr.pos})
+		}
+	}
+}
+
+// cleanArchiveNameはアーカイブ内の名前を正規化します。
+// 親フォルダーを指す名前などは、ルートより上に出ないように丸めます。
+func cleanArchiveName(name string) string {
+	name = path.Clean("/" + strings.ReplaceAll(name, `\`, "/"))
+	return strings.TrimPrefix(name, "/")
+}
+
+// addEntryはファイルを登録し、途中のフォルダーも登録します。
+func (a *virtualArchive) addEntry(entry *archiveEntry) {
+	a.entries[entry.name] = entry
+	a.addDir(path.Dir(entry.name), entry.modTime)
+}
+
+// addDirはフォルダーと、その親のフォルダーを登録します。
+func (a *virtualArchive) addDir(name string, modTime time.Time) {
+	for name != "." && name != "" {
+		if entry, ok := a.entries[name]; ok && entry.isDir {
+			return
+		}
+		a.entries[name] = &archiveEntry{name: name, isDir: true, modTime: modTime}
+		name = path.Dir(name)
+	}
+}
+
+// Closeはアーカイブファイルを閉じます。
+func (a *virtualArchive) Close() error {
+	return a.file.Close()
+}
+
+// statはアーカイブ内のパスの項目を返します。
+func (a *virtualArchive) stat(name string) (*archiveEntry, bool) {
+	entry, ok := a.entries[name]
+	return entry, ok
+}
+
+// readDirはアーカイブ内のフォルダーの直下にある項目を返します。
+func (a *virtualArchive) readDir(dir string) []*archiveEntry {
+	var result []*archiveEntry
+	for name, entry := range a.entries {
+		if name == "" {
+			continue
+		}
+		parent := path.Dir(name)
+		if parent == "." {
+			parent = ""
+		}
+		if parent == dir {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// openはアーカイブ内のファイルを開きます。使い終わったらCloseすること。
+// TARと無圧縮のZIPはアーカイブファイルを直接読むので、io.ReadSeekerでもあり、Rangeリクエストに使えます。
+// 圧縮されたZIPは展開しながら読むのでシークできません（メモリーに全体を読み込まないため）。
+func (a *virtualArchive) open(entry *archiveEntry) (io.ReadCloser, error) {
+	if entry.isDir {
+		return nil, errors.New("フォルダーは開けません")
+	}
+	if entry.zipFile == nil {
+		return archiveSection{io.NewSectionReader(a.file, entry.tarOffset, entry.size)}, nil
+	}
+	zf := entry.zipFile
+	if zf.Method == zip.Store && zf.CompressedSize64 == zf.UncompressedSize64 {
+		offset, err := zf.DataOffset()
+		if err != nil {
+			return nil, fmt.Errorf("ZIP内のファイルの位置が分かりません: %w", err)
+		}
+		return archiveSection{io.NewSectionReader(a.file, offset, int64(zf.UncompressedSize64))}, nil
+	}
+	// 展開した大きさは目次の大きさを超えない（超えたらzipパッケージがエラーにする）
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, fmt.Errorf("ZIP内のファイルのオープンに失敗しました: %w", err)
+	}
+	return rc, nil
+}
+
+// archiveSectionはアーカイブファイルの一部分です。アーカイブファイル自体はvirtualArchiveが閉じます。
+type archiveSection struct {
+	*io.SectionReader
+}
+
+func (archiveSection) Close() error {
+	return nil
+}
+
+// positionReaderは読み込んだ位置を記録するReaderです。
+// tar.Readerはio.Seekerがあればデータを読まずにSeekで読み飛ばします。
+type positionReader struct {
+	file	*os.File
+	pos		int64
+}
+
+func (p *positionReader) Read(b []byte) (int, error) {
+	n, err := p.file.ReadAt(b, p.pos)
+	p.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (p *positionReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		p.pos = offset
+	case io.SeekCurrent:
+		p.pos += offset
+	case io.SeekEnd:
+		info, err := p.file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		p.pos = info.Size() + offset
+	}
+	return p.pos, nil
+}
+
+// handleArchiveObjectはアーカイブ内のフォルダーの一覧、またはファイルを返します。
+func handleArchiveObject(w http.ResponseWriter, r *http.Request, archivePath string, inner string, config *ServerConfig, folderTmpl *template.Template, err404Tmpl *template.Template) {
+	archive, err := openVirtualArchive(archivePath)
+	if err != nil {
+		log.Printf("Archive: %v: '%s'", err, archivePath)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
+		return
+	}
+	defer archive.Close()
+
+	entry, ok := archive.stat(inner)
+	if !ok {
+		log.Printf("Archive: 404: '%s' の '%s'", archivePath, inner)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
+		return
+	}
+
+	// ファイルのときはアーカイブから直接送信
+	if !entry.isDir {
+		reader, err := archive.open(entry)
+		if err != nil {
+			log.Printf("Archive: %v: '%s' の '%s'", err, archivePath, inner)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
+			return
+		}
+		defer reader.Close()
+		log.Printf("Archive: アーカイブ内のファイルの送信: '%s' の '%s'", archivePath, inner)
+		if seeker, ok := reader.(io.ReadSeeker); ok {
+			http.ServeContent(w, r, path.Base(entry.name), entry.modTime, seeker)
+		} else {
+			serveArchiveStream(w, r, entry, reader)
+		}
+		return
+	}
+
+	// フォルダーのURLは/で終わるようにする（相対リンクのため）
+	if !strings.HasSuffix(r.URL.Path, "/") {
+		http.Redirect(w, r, path.Base(r.URL.Path)+"/", http.StatusSeeOther)
+		return
+	}
+
+	data := buildArchiveFolderData(r, archive, archivePath, inner, config)
+	log.Printf("Archive: アーカイブ内のリストを表示 '%s' の '%s'", archivePath, inner)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := folderTmpl.Execute(w, data); err != nil {
+		log.Printf("Archive: テンプレートの実行に失敗しました: %v", err)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
+	}
+}
+
+// serveArchiveStreamはシークできないアーカイブ内のファイルを、Rangeリクエストを使わずに先頭から送信します。
+func serveArchiveStream(w http.ResponseWriter, r *http.Request, entry *archiveEntry, reader io.Reader) {
+	if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !entry.modTime.Truncate(time.Second).After(t) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	contentType := mime.TypeByExtension(path.Ext(entry.name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", fmt.Sprint(entry.size))
+	w.Header().Set("Last-Modified", entry.modTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "none")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, reader); err != nil {
+		log.Printf("Archive: アーカイブ内のファイルの送信に失敗しました: '%s' %v", entry.name, err)
+	}
+}
+
+// buildArchiveFolderDataはアーカイブ内のフォルダーの一覧を、フォルダーテンプレートに渡すデータにします。
+func buildArchiveFolderData(r *http.Request, archive *virtualArchive, archivePath string, inner string, config *ServerConfig) FolderData {
+	format := newLocaleFormatter(r)
+
+	var list []WS_FileEntry
+	for _, entry := range archive.readDir(inner) {
+		name := path.Base(entry.name)
+		if ignored, _ := isIgnored(name, config.Ignores); ignored {
+			continue
+		}
+		fileEntry := WS_FileEntry{
+			WS_Name:		name,
+			WS_LastMod:		entry.modTime.Format("2006-01-02 15:04:05"),
+			WS_LastModText:	format.date(entry.modTime),
+			WS_IsDirectory:	entry.isDir,
+			WS_IconPath:	template.URL(url.PathEscape(name) + ".icon"),
+			size:			entry.size,
+			modTime:		entry.modTime,
+		}
+		if entry.isDir {
+			fileEntry.WS_Link = url.PathEscape(name) + "/"
+		} else {
+			fileEntry.WS_IsImage = isImageFile(name)
+			fileEntry.WS_Link = getEntryPath(r.URL.Path, name, false, fileEntry.WS_IsImage)
+			fileEntry.WS_Size = format.size(entry.size)
+			fileEntry.WS_Bytes = entry.size
+			fileEntry.WS_MimeType = mime.TypeByExtension(path.Ext(name))
+		}
+		list = append(list, fileEntry)
+	}
+
+	sortOpts := getSortOptions(r, config)
+	sortEntries(list, sortOpts)
+	order := "asc"
+	if sortOpts.Desc {
+		order = "desc"
+	}
+	query := listingQuery(r)
+
+	title := filepath.Base(archivePath)
+	if inner != "" {
+		title = path.Base(inner)
+	}
+	view := r.URL.Query().Get("view")
+	if view != "grid" && view != "detail" {
+		view = "list"
+	}
+	// アーカイブの中のフォルダーのしおり
+	resumeLink, resumeText := folderBookmark(viewerID(r), getRequestedPath(r), config)
+
+	return FolderData{
+		WS_Title:		title,
+		WS_Link:		r.URL.Path,
+		WS_ParentPath:	path.Dir(strings.TrimSuffix(r.URL.Path, "/")) + "/",
+		WS_View:		view,
+		WS_Sort:		sortOpts.Key,
+		WS_Order:		order,
+		WS_Query:		template.URL(query.Encode()),
+		WS_IsArchive:	true,
+		WS_Objects:		list,
+		WS_ResumeLink:	resumeLink,
+		WS_ResumeText:	resumeText,
+		query:			query,
+	}
+}
+
+// buildArchiveImageDataはアーカイブ内の画像を、画像ビューアに渡すデータにします。
+func buildArchiveImageData(r *http.Request, archivePath string, inner string, config *ServerConfig) (ImageData, error) {
+	archive, err := openVirtualArchive(archivePath)
+	if err != nil {
+		return ImageData{}, err
+	}
+	defer archive.Close()
+
+	if entry, ok := archive.stat(inner); !ok || entry.isDir {
+		return ImageData{}, os.ErrNotExist
+	}
+
+	dir := path.Dir(inner)
+	if dir == "." {
+		dir = ""
+	}
+	var items []sortItem
+	mode := imageModeNormal
+	for _, entry := range archive.readDir(dir) {
+		name := path.Base(entry.name)
+		switch name {
+		case "__option_R2L__":
+			mode = imageModeR2L
+		case "__option_360VR__":
+			if mode == imageModeNormal {
+				mode = imageMode360VR
+			}
+		}
+		if entry.isDir || !isImageFile(name) {
+			continue
+		}
+		if ignored, _ := isIgnored(name, config.Ignores); ignored {
+			continue
+		}
+		items = append(items, sortItem{name: name, size: entry.size, modTime: entry.modTime})
+	}
+
+	// アーカイブ内に指定が無いときは、アーカイブが置かれているフォルダーの指定に従う
+	if mode == imageModeNormal {
+		parentDir := filepath.Dir(archivePath)
+		if _, err := os.Stat(filepath.Join(parentDir, "__option_R2L__")); err == nil {
+			mode = imageModeR2L
+		} else if _, err := os.Stat(filepath.Join(parentDir, "__option_360VR__")); err == nil {
+			mode = imageMode360VR
+		}
+	}
+
+	sortOpts := getSortOptions(r, config)
+	sort.SliceStable(items, func(i, j int) bool {
+		return sortOpts.less(items[i], items[j])
+	})
+
+	var imagePaths []string
+	currentIndex := -1
+	for idx, item := range items {
+		imagePaths = append(imagePaths, url.PathEscape(item.name))
+		if item.name == path.Base(inner) {
+			currentIndex = idx
+		}
+	}
+
+	return ImageData{
+		WS_Title:			template.URL(path.Base(inner)),
+		WS_Link:			template.URL(r.URL.Path),
+		WS_Mode:			mode,
+		WS_CurrentIndex:	currentIndex,
+		WS_ImagePaths:		imagePaths,
+		WS_ImageFile:		path.Base(inner),
+		WS_BaseURL:			template.URL(path.Dir(r.URL.Path) + "/"),
+	}, nil
+}
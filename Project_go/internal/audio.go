@@ -0,0 +1,270 @@
+// Functions/audio.go:音声プレイヤーハンドラ:Functions/audio.go
+//
+// 音声ファイルを<ファイル>.audio.htmlのプレイヤーで再生する
+// 同じフォルダーの音声ファイルをアルバムとみなし、曲の一覧・タグ・カバー画像を表示して順番に再生する
+// ブラウザーで再生できない形式は、ffmpegでAACに変換しながら送信する
+//
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ブラウザーでそのまま再生できる音声ファイルの拡張子
+var browserAudioExtensions = map[string]bool{
+	".mp3": true, ".m4a": true, ".aac": true, ".flac": true, ".ogg": true, ".oga": true, ".opus": true, ".wav": true,
+}
+
+// フォルダーのカバー画像として使うファイル名（拡張子を除く）
+var folderCoverNames = []string{"cover", "folder", "front", "album"}
+
+// needsAudioTranscodeはブラウザーでそのまま再生できず、変換が必要な音声ファイルかどうかを返します。
+// ffprobeを使うのは、中身を調べないと分からない.m4aのときだけです。
+func needsAudioTranscode(ctx context.Context, filePath string, info os.FileInfo, config *ServerConfig) bool {
+	var probe *movieProbe
+	if strings.EqualFold(filepath.Ext(filePath), ".m4a") {
+		probe, _ = probeMovie(ctx, filePath, info, config)
+	}
+	return audioTranscodeNeeded(filePath, probe)
+}
+
+// audioTranscodeNeededは、取得済みの情報から変換が必要かどうかを返します。probeはnilでもかまいません。
+// .m4aでもALACはブラウザーが対応していないので変換します。
+func audioTranscodeNeeded(filePath string, probe *movieProbe) bool {
+	ext := strings.ToLower(filepath.Ext(filePath))
+	if !browserAudioExtensions[ext] {
+		return true
+	}
+	if ext == ".m4a" && probe != nil {
+		if audio, ok := probe.audioStream(); ok && audio.CodecName == "alac" {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleAudioStreamingは音声ファイルを送信します。ブラウザーで再生できない形式はAACに変換します。
+func HandleAudioStreaming(resolvedFolders map[string]string, config *ServerConfig, err404Tmpl *template.Template) http.HandlerFunc {
+	paths := newPathResolver(resolvedFolders, config)
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestedPath := getRequestedPath(r)
+
+		// リクエストされたファイルパスを得る
+		fullPath, info, ok := paths.resolveFile(requestedPath)
+		if !ok || !IsAudioFile(fullPath) {
+			log.Printf("Audio: 404: '%s'", requestedPath)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusNotFound)
+			err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
+			return
+		}
+
+		// ?original=1のときは変換せずにそのまま送信（外部のプレイヤーで再生するプレイリスト用）
+		if r.URL.Query().Get("original") == "1" || !needsAudioTranscode(r.Context(), fullPath, info, config) {
+			log.Printf("Audio: 音声ファイルの送信: '%s'", fullPath)
+			http.ServeFile(w, r, fullPath)
+			return
+		}
+
+		// 変換しながら送信する（?t=秒でその位置から変換する）
+		start := parseStartOffset(r, 0)
+		log.Printf("Audio: AACに変換して送信: '%s' (%.1f秒から)", requestedPath, start)
+		var args []string
+		if start > 0 {
+			args = append(args, "-ss", strconv.FormatFloat(start, 'f', 3, 64))
+		}
+		args = append(args,
+			"-i", fullPath,
+			"-map", "0:a:0",
+			"-vn",
+			"-c:a", "aac",
+			"-b:a", "256k",
+			"-f", "adts",
+			"pipe:1")
+		streamFFmpeg(w, r, fullPath, "audio", args, "audio/aac", config)
+	}
+}
+
+// HandleAudioPageは音声プレイヤーのページをレンダリングします。
+func HandleAudioPage(resolvedFolders map[string]string, config *ServerConfig, audioTmpl *template.Template, err404Tmpl *template.Template) http.HandlerFunc {
+	paths := newPathResolver(resolvedFolders, config)
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestedPath := getRequestedPath(r)
+
+		log.Printf("Audio: 音声プレイヤー: '%s'", requestedPath)
+
+		// 元の音声ファイルのパスを取得するために.audio.htmlを削除
+		originalPath := strings.TrimSuffix(requestedPath, ".audio.html")
+
+		fullPath, _, ok := paths.resolveFile(originalPath)
+		if !ok || !IsAudioFile(fullPath) {
+			log.Printf("Audio: 404: '%s'", requestedPath)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusNotFound)
+			err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
+			return
+		}
+
+		audioData, err := buildAudioData(r, fullPath, config)
+		if err != nil {
+			log.Printf("Audio: フォルダの読み込みに失敗しました: '%s' %v", fullPath, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := audioTmpl.Execute(w, audioData); err != nil {
+			log.Printf("Audio: テンプレートの実行に失敗しました: %v", err)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
+		}
+	}
+}
+
+// buildAudioDataは同じフォルダーの音声ファイルを、フォルダーリストと同じ並び順のアルバムにします。
+func buildAudioData(r *http.Request, fullPath string, config *ServerConfig) (AudioTemplateData, error) {
+	parentDir := filepath.Dir(fullPath)
+	dirEntries, err := os.ReadDir(parentDir)
+	if err != nil {
+		return AudioTemplateData{}, err
+	}
+
+	// 並べ替えの情報と、ffprobeに渡すos.FileInfo
+	type audioEntry struct {
+		sortItem
+		info	os.FileInfo
+	}
+	var audioEntries []audioEntry
+	for _, entry := range dirEntries {
+		if entry.IsDir() || !IsAudioFile(entry.Name()) {
+			continue
+		}
+		if ignored, _ := isIgnored(entry.Name(), config.Ignores); ignored {
+			continue
+		}
+		item := audioEntry{sortItem: sortItem{name: entry.Name()}}
+		if info, err := entry.Info(); err == nil {
+			item.size, item.modTime, item.info = info.Size(), info.ModTime(), info
+		}
+		audioEntries = append(audioEntries, item)
+	}
+	sortOpts := getSortOptions(r, config)
+	sort.SliceStable(audioEntries, func(i, j int) bool {
+		return sortOpts.less(audioEntries[i].sortItem, audioEntries[j].sortItem)
+	})
+
+	folderCover, hasFolderCover := findFolderCover(parentDir, config)
+
+	data := AudioTemplateData{
+		WS_Title:			filepath.Base(fullPath),
+		WS_Album:			filepath.Base(parentDir),
+		WS_BaseURL:			template.URL(filepath.Dir(r.URL.Path) + "/"),
+		WS_CurrentIndex:	-1,
+	}
+	if hasFolderCover {
+		data.WS_Cover = url.PathEscape(folderCover)
+	}
+
+	for idx, entry := range audioEntries {
+		entryPath := filepath.Join(parentDir, entry.name)
+		escaped := url.PathEscape(entry.name)
+		track := AlbumTrack{
+			WS_Name:	entry.name,
+			WS_Link:	escaped,
+			WS_Page:	escaped + ".audio.html",
+			WS_Title:	strings.TrimSuffix(entry.name, filepath.Ext(entry.name)),
+			WS_Cover:	data.WS_Cover,
+		}
+		track.WS_Transcoded = audioTranscodeNeeded(entryPath, nil)
+		if entry.info != nil {
+			// 1曲につき1回だけffprobeを使い、変換が必要かどうかもその結果で決める
+			if probe, err := probeMovie(r.Context(), entryPath, entry.info, config); err == nil {
+				track.WS_Transcoded = audioTranscodeNeeded(entryPath, probe)
+				if title := probe.tag("title"); title != "" {
+					track.WS_Title = title
+				}
+				track.WS_Artist = probe.tag("artist")
+				track.WS_Album = probe.tag("album")
+				// "3/12"のような曲番号は、前の数字だけを使う
+				track.WS_TrackNo, _, _ = strings.Cut(probe.tag("track"), "/")
+				if duration := probe.duration(); duration > 0 {
+					track.WS_Duration = duration
+					track.WS_DurationText = formatDuration(duration)
+				}
+				if _, ok := probe.coverStream(); ok {
+					track.WS_Cover = fmt.Sprintf("%s.thumb?size=%d", escaped, 512)
+				}
+			} else {
+				log.Printf("Audio: 音声ファイルの情報を取得できません: '%s' %v", entryPath, err)
+			}
+		}
+		if track.WS_TrackNo == "" {
+			track.WS_TrackNo = strconv.Itoa(idx + 1)
+		}
+		if entry.name == filepath.Base(fullPath) {
+			data.WS_CurrentIndex = idx
+			data.WS_Title = track.WS_Title
+			if track.WS_Album != "" {
+				data.WS_Album = track.WS_Album
+			}
+			if data.WS_Cover == "" {
+				data.WS_Cover = track.WS_Cover
+			}
+		}
+		data.WS_Tracks = append(data.WS_Tracks, track)
+	}
+	return data, nil
+}
+
+// findFolderCoverはフォルダーのカバー画像（cover.jpg、folder.pngなど）のファイル名を返します。
+func findFolderCover(dir string, config *ServerConfig) (string, bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", false
+	}
+	for _, coverName := range folderCoverNames {
+		for _, entry := range entries {
+			name := entry.Name()
+			ext := strings.ToLower(filepath.Ext(name))
+			if entry.IsDir() || (ext != ".jpg" && ext != ".jpeg" && ext != ".png") {
+				continue
+			}
+			if !strings.EqualFold(strings.TrimSuffix(name, filepath.Ext(name)), coverName) {
+				continue
+			}
+			if ignored, _ := isIgnored(name, config.Ignores); ignored {
+				continue
+			}
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// audioThumbnailは音声ファイルに埋め込まれたカバー画像を取り出し、JPEGで書き出します。
+func audioThumbnail(ctx context.Context, w io.Writer, filePath string, size int, config *ServerConfig) error {
+	scale := fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease", size, size)
+	return runThumbnailCommand(ctx, w, filePath, config, "ffmpeg",
+		"-v", "error",
+		"-i", filePath,
+		"-an",
+		"-map", "0:v:0",
+		"-frames:v", "1",
+		"-vf", scale,
+		"-f", "image2",
+		"-c:v", "mjpeg",
+		"pipe:1")
+}
@@ -0,0 +1,173 @@
+// Functions/bookmark.go:画像ビューアのしおり:Functions/bookmark.go
+//
+// 画像ビューアで最後に表示していた画像を、閲覧者ごと・フォルダーごとに作業用フォルダーのbookmarks.jsonに保存する
+// 画像ビューアがページをめくるたびに /api/v1/bookmark/<フォルダー> へ送信する
+// 最後の画像まで表示したフォルダーは既読にする。フォルダーリストには既読・読みかけと「続きから読む」のリンクを表示する
+// アーカイブ（.zip・.cbzなど）の中の画像も、アーカイブをフォルダーとみなして保存する
+//
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// しおりに関する値
+const (
+	bookmarkMaxEntries	= 500				// 閲覧者ごとに保存する数
+	bookmarkSaveDelay	= 5 * time.Second	// 書き込みをまとめる間隔
+)
+
+// フォルダーの読書状態
+const (
+	readStateReading	= "reading"	// 読みかけ
+	readStateRead		= "read"	// 最後の画像まで表示した
+)
+
+// bookmarkEntryは1つのフォルダーのしおりです。
+type bookmarkEntry struct {
+	File	string		`json:"file"`		// 最後に表示していた画像のファイル名
+	Index	int			`json:"index"`		// その画像の番号（0から）
+	Count	int			`json:"count"`		// フォルダーの画像の数
+	Read	bool		`json:"read"`		// 一度でも最後の画像まで表示した
+	Updated	time.Time	`json:"updated"`
+}
+
+// bookmarkStoreは閲覧者ごとのしおりを、フォルダーの仮想パスをキーにして保存します。
+type bookmarkStore struct {
+	*viewerStore[bookmarkEntry]
+}
+
+// updatedAtは古いものから消すための更新日時を返します。
+func (e bookmarkEntry) updatedAt() time.Time {
+	return e.Updated
+}
+
+var (
+	bookmarkStoreOnce	sync.Once
+	bookmarkStoreInst	bookmarkStore
+)
+
+// getBookmarkStoreはしおりの保存先を返します。最初に呼ばれたときにファイルから読み込みます。
+func getBookmarkStore(config *ServerConfig) bookmarkStore {
+	bookmarkStoreOnce.Do(func() {
+		bookmarkStoreInst = bookmarkStore{newViewerStore[bookmarkEntry]("Bookmark",
+			filepath.Join(config.Config.Temporary, "bookmarks.json"), bookmarkMaxEntries, bookmarkSaveDelay)}
+	})
+	return bookmarkStoreInst
+}
+
+// setPageはしおりを保存します。最後の画像まで表示したときは既読にします。
+func (s bookmarkStore) setPage(viewer string, folderPath string, file string, index int, count int) bookmarkEntry {
+	return s.set(viewer, folderPath, func(prev bookmarkEntry, _ bool) bookmarkEntry {
+		return bookmarkEntry{
+			File:		file,
+			Index:		index,
+			Count:		count,
+			Read:		prev.Read || index >= count-1,
+			Updated:	time.Now(),
+		}
+	})
+}
+
+// readingStateはフォルダーの読書状態と、続きから読むための画像ビューアのURLを返します。
+// しおりが無いときは空を返します。
+func readingState(viewer string, folderPath string, config *ServerConfig) (string, string) {
+	if viewer == "" {
+		return "", ""
+	}
+	entry, ok := getBookmarkStore(config).get(viewer, folderPath)
+	if !ok {
+		return "", ""
+	}
+	state := readStateReading
+	if entry.Read {
+		state = readStateRead
+	}
+	return state, bookmarkLink(folderPath, entry)
+}
+
+// folderBookmarkは開いているフォルダーのしおりの画像ビューアのURLと、"12 / 40"のような位置を返します。
+func folderBookmark(viewer string, folderPath string, config *ServerConfig) (string, string) {
+	if viewer == "" {
+		return "", ""
+	}
+	entry, ok := getBookmarkStore(config).get(viewer, folderPath)
+	if !ok {
+		return "", ""
+	}
+	return bookmarkLink(folderPath, entry), fmt.Sprintf("%d / %d", entry.Index+1, entry.Count)
+}
+
+// bookmarkLinkはしおりの画像を表示する画像ビューアのURLを返します。
+func bookmarkLink(folderPath string, entry bookmarkEntry) string {
+	return "/" + escapeURLPath(folderPath) + "/" + url.PathEscape(entry.File) + ".image.html"
+}
+
+// isBookmarkFolderは、しおりを保存できるフォルダー（またはアーカイブ）かどうかを返します。
+func isBookmarkFolder(fullPath string) bool {
+	info, err := os.Stat(fullPath)
+	if err == nil {
+		return info.IsDir() || (info.Mode().IsRegular() && isBrowsableArchive(fullPath))
+	}
+	_, _, ok := findArchivePath(fullPath)
+	return ok
+}
+
+// handleBookmarkAPIは /api/v1/bookmark/<フォルダー> へのリクエストを処理します。
+//
+//	GET    /api/v1/bookmark/<フォルダー>	しおり
+//	POST   /api/v1/bookmark/<フォルダー>	しおりを保存する {"file": ファイル名, "index": 番号, "count": 画像の数}
+//	DELETE /api/v1/bookmark/<フォルダー>	しおりを消して未読に戻す
+func handleBookmarkAPI(w http.ResponseWriter, r *http.Request, paths pathResolver, requestedPath string, config *ServerConfig) {
+	store := getBookmarkStore(config)
+
+	target, ok := paths.resolve(requestedPath)
+	if !ok || !isBookmarkFolder(target.fullPath) {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	folderPath := target.virtualPath()
+
+	switch r.Method {
+	case http.MethodGet:
+		entry, ok := store.get(viewerID(r), folderPath)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "no bookmark")
+			return
+		}
+		writeJSON(w, http.StatusOK, entry)
+
+	case http.MethodPost, http.MethodPut:
+		// navigator.sendBeaconはContent-Typeを指定できないので、ヘッダーは見ない
+		var body struct {
+			File	string	`json:"file"`
+			Index	int		`json:"index"`
+			Count	int		`json:"count"`
+		}
+		err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&body)
+		if err != nil || body.Index < 0 || body.Count <= body.Index || !isImageFile(body.File) || strings.ContainsAny(body.File, `/\`) {
+			writeJSONError(w, http.StatusBadRequest, "invalid bookmark")
+			return
+		}
+		viewer := ensureViewerID(w, r)
+		writeJSON(w, http.StatusOK, store.setPage(viewer, folderPath, body.File, body.Index, body.Count))
+
+	case http.MethodDelete:
+		store.remove(viewerID(r), folderPath)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,344 @@
+// Functions/cache.go:縮小画像のディスクキャッシュ:Functions/cache.go
+//
+// 縮小した画像を作業用フォルダーのcache/以下に保存し、次回からは再利用する
+// キーは元ファイルのパス・更新日時・サイズ・縮小後の大きさから作るので、元ファイルが変われば自動的に作り直される
+// 合計サイズが上限を超えたときは、最後に使われた時刻が古いものから削除する
+//
+
+package internal
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// キャッシュのデフォルトの上限（MB）
+const defaultCacheMaxSize = 1024
+
+// 作成中のファイルの名前の先頭
+const cacheTempPrefix = ".tmp-"
+
+// diskCacheは作業用フォルダーに置かれるLRUキャッシュです。
+type diskCache struct {
+	dir			string
+	maxBytes	int64
+
+	mu			sync.Mutex
+	totalBytes	int64
+	entries		map[string]*list.Element	// ファイル名 -> LRUリストの要素
+	lru			*list.List					// 先頭が最も新しく使われたもの
+	building	map[string]*cacheBuild		// 作成中のキー
+}
+
+// cacheEntryはキャッシュされた1つのファイルを表します。
+type cacheEntry struct {
+	name	string
+	size	int64
+	pins	int		// 送信中などで使用中の数
+}
+
+// cacheBuildは同じキーの作成が同時に走らないようにするための待ち合わせです。
+// 作成は待っている全てのリクエストで共有するので、全員の接続が切れたときだけ中止します。
+type cacheBuild struct {
+	done	chan struct{}
+	err		error
+	cancel	context.CancelFunc
+	waiters	int		// 作成したリクエストを含む、結果を待っている数（c.muで保護）
+}
+
+var (
+	imageCacheOnce	sync.Once
+	imageCache		*diskCache
+)
+
+// getImageCacheは設定ファイルに従って、縮小画像用のキャッシュを返します。
+func getImageCache(config *ServerConfig) *diskCache {
+	imageCacheOnce.Do(func() {
+		maxSize := config.Config.Cache.MaxSize
+		if maxSize <= 0 {
+			maxSize = defaultCacheMaxSize
+		}
+		imageCache = newDiskCache(filepath.Join(config.Config.Temporary, "cache"), maxSize*1024*1024)
+	})
+	return imageCache
+}
+
+// newDiskCacheはキャッシュフォルダーを準備し、既存のファイルを読み込みます。
+func newDiskCache(dir string, maxBytes int64) *diskCache {
+	c := &diskCache{
+		dir:		dir,
+		maxBytes:	maxBytes,
+		entries:	make(map[string]*list.Element),
+		lru:		list.New(),
+		building:	make(map[string]*cacheBuild),
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("Cache: キャッシュフォルダーの作成に失敗しました: %v", err)
+		return c
+	}
+
+	// 前回までのファイルを更新日時の古い順に登録する
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Cache: キャッシュフォルダーの読み込みに失敗しました: %v", err)
+		return c
+	}
+	type existing struct {
+		name	string
+		size	int64
+		modTime	time.Time
+	}
+	var files []existing
+	for _, entry := range dirEntries {
+		// 作成中に終了したときの一時ファイルを削除する
+		if strings.HasPrefix(entry.Name(), cacheTempPrefix) {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				log.Printf("Cache: 一時ファイルの削除に失敗しました: %v", err)
+			}
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		files = append(files, existing{entry.Name(), info.Size(), info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for _, f := range files {
+		c.entries[f.name] = c.lru.PushFront(&cacheEntry{name: f.name, size: f.size})
+		c.totalBytes += f.size
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	log.Printf("Cache: %d 個のファイルを読み込みました (%s)", len(files), formatSize(c.totalBytes))
+	return c
+}
+
+// cacheKeyは元ファイルの情報と用途から、キャッシュのキーを作ります。
+func cacheKey(fullPath string, info os.FileInfo, variant string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00%s", fullPath, info.ModTime().UnixNano(), info.Size(), variant)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// getはキーに対応するファイルがキャッシュにあれば、そのパスを返します。
+// 返したファイルは使い終わるまで削除されないので、送信し終わったらreleaseを呼んでください。
+func (c *diskCache) get(name string) (string, func(), bool) {
+	for {
+		c.mu.Lock()
+		elem, ok := c.entries[name]
+		if !ok {
+			c.mu.Unlock()
+			return "", nil, false
+		}
+		path, release, ok := c.hit(elem)
+		if ok {
+			return path, release, true
+		}
+	}
+}
+
+// getOrCreateはキーに対応するファイルのパスを返します。
+// キャッシュに無いときはcreateで作成してから返します。使い終わったらreleaseを呼んでください。
+// createに渡すctxは、同じキーを待っている全てのリクエストのctxが終わったときにキャンセルされます。
+func (c *diskCache) getOrCreate(ctx context.Context, name string, create func(ctx context.Context, w io.Writer) error) (string, func(), error) {
+	return c.getOrCreateFile(ctx, name, func(ctx context.Context, tmp *os.File) error {
+		return create(ctx, tmp)
+	})
+}
+
+// getOrCreateFileはgetOrCreateと同じですが、作成用の一時ファイルをそのまま渡します。
+// 外部コマンドにファイル名を渡して書き出させるときに使います。
+func (c *diskCache) getOrCreateFile(ctx context.Context, name string, create func(ctx context.Context, tmp *os.File) error) (string, func(), error) {
+	path := filepath.Join(c.dir, name)
+
+	for {
+		c.mu.Lock()
+		if elem, ok := c.entries[name]; ok {
+			if path, release, ok := c.hit(elem); ok {
+				return path, release, nil
+			}
+			// キャッシュの外で削除されていたので作り直す
+			continue
+		}
+		if b, ok := c.building[name]; ok {
+			// 他のリクエストが作成中なので、終わるのを待つ
+			b.waiters++
+			c.mu.Unlock()
+			select {
+			case <-b.done:
+			case <-ctx.Done():
+				c.leave(b)
+				return "", nil, ctx.Err()
+			}
+			// 他の全員の接続が切れて中止されたときは、作り直す
+			if b.err != nil && !(errors.Is(b.err, context.Canceled) && ctx.Err() == nil) {
+				return "", nil, b.err
+			}
+			continue
+		}
+		buildCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		b := &cacheBuild{done: make(chan struct{}), cancel: cancel, waiters: 1}
+		c.building[name] = b
+		c.mu.Unlock()
+
+		stop := context.AfterFunc(ctx, func() { c.leave(b) })
+		size, err := c.write(path, func(tmp *os.File) error {
+			return create(buildCtx, tmp)
+		})
+		stop()
+		cancel()
+
+		c.mu.Lock()
+		delete(c.building, name)
+		var release func()
+		if err == nil {
+			entry := &cacheEntry{name: name, size: size}
+			c.entries[name] = c.lru.PushFront(entry)
+			c.totalBytes += size
+			release = c.pin(entry)
+			c.evict()
+		}
+		c.mu.Unlock()
+		b.err = err
+		close(b.done)
+		if err != nil {
+			return "", nil, err
+		}
+		return path, release, nil
+	}
+}
+
+// leaveは作成を待っているリクエストが1つ減ったことを記録し、誰も待っていなければ作成を中止します。
+func (c *diskCache) leave(b *cacheBuild) {
+	c.mu.Lock()
+	b.waiters--
+	if b.waiters == 0 {
+		b.cancel()
+	}
+	c.mu.Unlock()
+}
+
+// hitはキャッシュにあったファイルを使用中にして、パスを返します。
+// ファイルがキャッシュの外で削除されていたときは登録を取り消してfalseを返します。
+// 呼び出し側でc.muをロックしておくこと。ロックは必ず解除されます。
+func (c *diskCache) hit(elem *list.Element) (string, func(), bool) {
+	entry := elem.Value.(*cacheEntry)
+	c.lru.MoveToFront(elem)
+	release := c.pin(entry)
+	c.mu.Unlock()
+
+	path := filepath.Join(c.dir, entry.name)
+	now := time.Now()
+	// 再起動後もLRUの順番が保たれるように
+	if err := os.Chtimes(path, now, now); err != nil && os.IsNotExist(err) {
+		release()
+		c.mu.Lock()
+		if c.entries[entry.name] == elem {
+			c.lru.Remove(elem)
+			delete(c.entries, entry.name)
+			c.totalBytes -= entry.size
+		}
+		c.mu.Unlock()
+		log.Printf("Cache: キャッシュファイルが見つからないため作り直します: %s", entry.name)
+		return "", nil, false
+	}
+	return path, release, true
+}
+
+// pinはファイルを使用中にして、使い終わったときに呼ぶ関数を返します。使用中のファイルは削除しません。
+// 呼び出し側でc.muをロックしておくこと。
+func (c *diskCache) pin(entry *cacheEntry) func() {
+	entry.pins++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			entry.pins--
+			// 使用中のため削除できなかった分を減らす
+			c.evict()
+			c.mu.Unlock()
+		})
+	}
+}
+
+// writeは一時ファイルに書き出してから名前を変更し、書きかけのファイルが使われないようにします。
+func (c *diskCache) write(path string, create func(tmp *os.File) error) (int64, error) {
+	tmp, err := os.CreateTemp(c.dir, cacheTempPrefix+"*")
+	if err != nil {
+		return 0, fmt.Errorf("キャッシュファイルの作成に失敗しました: %w", err)
+	}
+	if err := create(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	info, err := tmp.Stat()
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, fmt.Errorf("キャッシュファイルの書き込みに失敗しました: %w", err)
+	}
+	return info.Size(), nil
+}
+
+// evictは合計サイズが上限以下になるまで、古いファイルを削除します。使用中のファイルは飛ばします。
+// 呼び出し側でc.muをロックしておくこと。
+func (c *diskCache) evict() {
+	for elem := c.lru.Back(); elem != nil && c.totalBytes > c.maxBytes && c.lru.Len() > 1; {
+		entry := elem.Value.(*cacheEntry)
+		prev := elem.Prev()
+		if entry.pins > 0 {
+			elem = prev
+			continue
+		}
+		c.lru.Remove(elem)
+		delete(c.entries, entry.name)
+		c.totalBytes -= entry.size
+		if err := os.Remove(filepath.Join(c.dir, entry.name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Cache: ファイル削除エラー: %v", err)
+		} else {
+			log.Printf("Cache: 古いファイルを削除: %s", entry.name)
+		}
+		elem = prev
+	}
+}
+
+// serveCachedFileはキャッシュされたファイルを、元ファイルの更新日時とETagを付けて送信します。
+// If-None-MatchやIf-Modified-Sinceが一致するときは304を返します。
+func serveCachedFile(w http.ResponseWriter, r *http.Request, cachedPath string, key string, modTime time.Time) {
+	f, err := os.Open(cachedPath)
+	if err != nil {
+		log.Printf("Cache: キャッシュファイルのオープンに失敗しました: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("ETag", `"`+key[:32]+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=0, must-revalidate")
+	http.ServeContent(w, r, filepath.Base(cachedPath), modTime, f)
+}
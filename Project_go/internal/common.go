@@ -12,6 +12,7 @@ import (
 	"path/filepath"
 	"strings"
 	"mime"
+	"time"
 )
 
 // ServerConfigはsettings.jsonの構造を定義します。
@@ -21,12 +22,71 @@ type ServerConfig struct {
 			Port int `json:"port"`
 		} `json:"server"`
 		Templates map[string]string `json:"templates"`
+		Sort struct {
+			Key				string	`json:"key"`			// "name"、"mtime"、"size"、"type"
+			Order			string	`json:"order"`			// "asc"または"desc"
+			FoldersFirst	bool	`json:"foldersFirst"`	// フォルダーをファイルより前に表示する
+		} `json:"sort"`
 		Temporary string
+		Symlinks	string	`json:"symlinks"`	// シンボリックリンクの扱い（"deny"、"allow-within-roots"、"allow-all"）
+		Image struct {
+			MaxSize	int	`json:"maxSize"`	// 縦横の長い辺がこれを超える画像は縮小して送信する
+			Quality	int	`json:"quality"`	// 縮小した画像をJPEGで保存するときの品質(1-100)
+			ThumbnailSize	int	`json:"thumbnailSize"`	// グリッド表示のサムネイルの大きさ
+		} `json:"image"`
+		Transcode struct {
+			MaxJobs			int	`json:"maxJobs"`		// 同時に動かすffmpegの数
+			QueueTimeout	int	`json:"queueTimeout"`	// 順番待ちの上限（秒）。超えたら503を返す
+			MaxToolJobs		int	`json:"maxToolJobs"`	// 同時に動かすffprobe・サムネイル・字幕の取り出しの数（ffmpegの変換とは別）
+			CacheSize		int64	`json:"cacheSize"`		// 変換済み動画のキャッシュの上限(MB)
+			Profile			string	`json:"profile"`		// 使うプロファイルの名前（?profile=名前でリクエストごとに変えられる）
+			Profiles		map[string]TranscodeProfile	`json:"profiles"`
+			Pretranscode	struct {
+				Enabled		bool		`json:"enabled"`	// 新しい動画を前もって変換しておく
+				Folders		[]string	`json:"folders"`	// 対象のフォルダー（URLの最初の階層の名前）。空のときは全て
+				Interval	int			`json:"interval"`	// フォルダーを調べる間隔（分）
+			} `json:"pretranscode"`
+		} `json:"transcode"`
+		HLS struct {
+			Enabled			bool			`json:"enabled"`			// 変換が必要な動画をHLSで再生する
+			SegmentSeconds	int				`json:"segmentSeconds"`	// セグメントの長さ（秒）
+			CacheSize		int64			`json:"cacheSize"`			// セグメントのキャッシュの上限(MB)
+			Renditions		[]HLSRendition	`json:"renditions"`		// 画質の一覧（高画質から順に）
+		} `json:"hls"`
+		Cache struct {
+			MaxSize	int64	`json:"maxSize"`	// 縮小画像キャッシュの上限(MB)
+		} `json:"cache"`
+		Icon struct {
+			Provider	string	`json:"provider"`	// "auto"、"builtin"、"theme"、"getIcon"
+			Size		int		`json:"size"`		// アイコンの大きさ（ピクセル）
+			ThemeDir	string	`json:"themeDir"`	// freedesktopのアイコンテーマのフォルダー
+			GetIcon		string	`json:"getIcon"`	// macOSのgetIconツールのパス
+			Sprite		bool	`json:"sprite"`		// フォルダーのアイコンを1つのCSSにまとめて送る
+		} `json:"icon"`
 	} `json:"config"`
 	Folders []string `json:"folders"`
 	Ignores []string `json:"ignores"`
 }
 
+// TranscodeProfileは動画を変換するときの設定を定義します。
+// ブラウザーで再生できるストリームは、プロファイルに関係なくそのままコピーされます。
+type TranscodeProfile struct {
+	VideoCodec		string	`json:"videoCodec"`		// ffmpegの映像エンコーダー（例: "libx264"）
+	CRF				*int	`json:"crf"`			// 画質（小さいほど高画質。0も指定できる）
+	Preset			string	`json:"preset"`			// エンコードの速さ（例: "veryfast"）
+	MaxHeight		int		`json:"maxHeight"`		// 縦の大きさの上限。これを超える映像はコピーせずに縮小する（0は無制限）
+	AudioCodec		string	`json:"audioCodec"`		// ffmpegの音声エンコーダー（例: "aac"）
+	AudioBitrate	int		`json:"audioBitrate"`	// 音声のビットレート(kbps)
+}
+
+// HLSRenditionはHLSの1つの画質を定義します。
+type HLSRendition struct {
+	Name			string	`json:"name"`			// URLに使われる名前（例: "720p"）
+	Height			int		`json:"height"`			// 縦の大きさ
+	VideoBitrate	int		`json:"videoBitrate"`	// 映像のビットレート(kbps)
+	AudioBitrate	int		`json:"audioBitrate"`	// 音声のビットレート(kbps)
+}
+
 // NotFoundDataは404テンプレートに渡されるデータを定義します。
 type NotFoundData struct {
 	WS_Link string
@@ -34,47 +94,189 @@ type NotFoundData struct {
 
 // WS_Object はフォルダリスト内の1つの項目を表す
 type WS_FileEntry struct {
-	WS_Name			string
-	WS_Link			string
-	WS_Size			string
-	WS_LastMod			string
-	WS_IsDirectory	bool
-	WS_IsMovie		bool
-	WS_IsImage		bool
-	WS_IconPath		template.URL
+	WS_Name			string			`json:"name"`
+	WS_Link			string			`json:"link"`
+	WS_Size			string			`json:"size,omitempty"`
+	WS_Bytes		int64			`json:"bytes,omitempty"`
+	WS_LastMod			string			`json:"lastModified,omitempty"`
+	WS_LastModText	string			`json:"lastModifiedText,omitempty"`	// 言語に合わせた書式
+	WS_MimeType		string			`json:"mimeType,omitempty"`
+	WS_Dimensions	string			`json:"dimensions,omitempty"`	// 画像の大きさ（詳細表示のときだけ）
+	WS_Duration		string			`json:"duration,omitempty"`	// 動画・音声の長さ（詳細表示のときだけ）
+	WS_IsDirectory	bool			`json:"isDirectory"`
+	WS_IsMovie		bool			`json:"isMovie"`
+	WS_IsAudio		bool			`json:"isAudio"`
+	WS_IsImage		bool			`json:"isImage"`
+	WS_IconPath		template.URL	`json:"icon,omitempty"`
+	WS_IconClass	string			`json:"-"`	// アイコンのスプライトのクラス名（icon.spriteが有効なときだけ）
+	WS_ThumbPath	template.URL	`json:"thumbnail,omitempty"`	// サムネイルを作成できないときは空
+	WS_Progress		int				`json:"progress,omitempty"`	// 見ている途中の動画の再生位置（%）
+	WS_ReadState	string			`json:"readState,omitempty"`	// 画像の読書状態（"reading"、"read"）
+	WS_ResumeLink	string			`json:"resume,omitempty"`		// しおりの画像を表示する画像ビューアのURL
+
+	size			int64		// 並べ替え用
+	modTime			time.Time	// 並べ替え用
 }
 
 // FolderDataはフォルダテンプレートに渡されるデータを定義します。
 type FolderData struct {
-	WS_Title		string
-	WS_Link			string
-	WS_ParentPath	string
-	WS_Objects		[]WS_FileEntry
+	WS_Title		string			`json:"title"`
+	WS_Link			string			`json:"link"`
+	WS_ParentPath	string			`json:"parent"`
+	WS_View			string			`json:"view,omitempty"`	// "list"、"grid"、"detail"
+	WS_Sort			string			`json:"sort,omitempty"`	// "name"、"mtime"、"size"、"type"
+	WS_Order		string			`json:"order,omitempty"`	// "asc"または"desc"
+	WS_Query		template.URL	`json:"-"`	// 下の階層や画像へのリンクに付けるクエリ
+	WS_IsArchive	bool			`json:"isArchive,omitempty"`	// アーカイブの中のフォルダー
+	WS_Objects		[]WS_FileEntry	`json:"objects"`
+	WS_Continue		[]WatchProgress	`json:"continue,omitempty"`	// 見ている途中の動画（トップページだけ）
+	WS_ResumeLink	string			`json:"resume,omitempty"`		// このフォルダーのしおりの画像を表示する画像ビューアのURL
+	WS_ResumeText	string			`json:"resumeText,omitempty"`	// "12 / 40"
+	WS_IconCSS		template.URL	`json:"-"`	// フォルダーのアイコンをまとめたCSSのURL（icon.spriteが有効なときだけ）
+
+	query			url.Values	// QueryWithで使う
 }
 
 // ImageDataは画像表示テンプレートに渡されるデータを定義します。
 type ImageData struct {
-	WS_Title		template.URL
-	WS_Link			template.URL
-	WS_BaseURL		template.URL
-	WS_CurrentIndex	int
-	WS_ImagePaths	[]string
-	WS_ImageFile	string
+	WS_Title		template.URL	`json:"title"`
+	WS_Link			template.URL	`json:"link"`
+	WS_BaseURL		template.URL	`json:"baseURL"`
+	WS_Mode			string			`json:"mode"`	// "normal"、"R2L"、"360VR"
+	WS_CurrentIndex	int				`json:"currentIndex"`
+	WS_ImagePaths	[]string		`json:"images"`
+	WS_ImageFile	string			`json:"file"`
+	WS_BookmarkLink	template.URL	`json:"bookmark,omitempty"`	// しおりを送信するAPIのURL
 }
 
 // ImageDataは画像表示テンプレートに渡されるデータを定義します。
 type MarkdownData struct {
-	WS_Title		template.URL
-	WS_Link			template.URL
-	WS_BaseURL		template.URL
-	WS_Content		template.HTML
+	WS_Title		template.URL	`json:"title"`
+	WS_Link			template.URL	`json:"link"`
+	WS_BaseURL		template.URL	`json:"baseURL"`
+	WS_Content		template.HTML	`json:"content"`
 }
 
 // VideoTemplateDataは動画表示テンプレートに渡されるデータを定義します。
 type VideoTemplateData struct {
-	WS_Title	string
-	WS_Link		string
-	WS_BaseURL	template.URL
+	WS_Title	string			`json:"title"`
+	WS_Link		string			`json:"link"`
+	WS_HLSLink	string			`json:"hls,omitempty"`	// HLSで再生するときのマスタープレイリスト
+	WS_BaseURL	template.URL	`json:"baseURL"`
+	WS_Transcoded	bool		`json:"transcoded"`			// 変換しながら送信する（?t=秒で途中から再生する）
+	WS_Duration		float64		`json:"duration,omitempty"`	// 動画の長さ（秒）
+	WS_DurationText	string		`json:"durationText,omitempty"`
+	WS_Start		float64		`json:"start,omitempty"`		// 再生を始める位置（秒）
+	WS_StartText	string		`json:"startText,omitempty"`
+	WS_Subtitles	[]SubtitleTrack	`json:"subtitles,omitempty"`
+	WS_Poster		string			`json:"poster,omitempty"`		// 動画の途中から取り出した静止画のURL
+	WS_Resolution	string			`json:"resolution,omitempty"`	// "1920x1080"
+	WS_VideoCodec	string			`json:"videoCodec,omitempty"`
+	WS_BitRate		string			`json:"bitRate,omitempty"`		// "5.2 Mbps"
+	WS_AudioTracks	[]AudioTrack	`json:"audioTracks,omitempty"`
+	WS_Chapters		[]VideoChapter	`json:"chapters,omitempty"`
+	WS_CurrentIndex	int				`json:"currentIndex"`
+	WS_MoviePaths	[]string		`json:"movies"`					// 同じフォルダーの動画（フォルダーリストと同じ並び順）
+	WS_PrevLink		template.URL	`json:"prev,omitempty"`			// 前の動画のページ
+	WS_PrevTitle	string			`json:"prevTitle,omitempty"`
+	WS_NextLink		template.URL	`json:"next,omitempty"`			// 次の動画のページ
+	WS_NextTitle	string			`json:"nextTitle,omitempty"`
+	WS_ProgressLink	template.URL	`json:"progress"`				// 再生位置を送信するAPIのURL
+	WS_Resumed		bool			`json:"resumed,omitempty"`		// 前回の続きから再生する
+}
+
+// WatchProgressは見ている途中の動画の再生位置を定義します。
+type WatchProgress struct {
+	WS_Name			string	`json:"name"`
+	WS_Path			string	`json:"path"`				// ルートフォルダーからのパス
+	WS_Link			string	`json:"link"`				// 動画のページ
+	WS_ThumbPath	string	`json:"thumbnail"`
+	WS_Position		float64	`json:"position"`			// 秒
+	WS_PositionText	string	`json:"positionText"`
+	WS_Duration		float64	`json:"duration,omitempty"`	// 秒
+	WS_Percent		int		`json:"percent"`
+	WS_Updated		string	`json:"updated"`
+}
+
+// AudioTrackは動画の音声ストリームの情報を定義します。
+type AudioTrack struct {
+	WS_Label	string	`json:"label"`		// 言語名やタイトル
+	WS_Codec	string	`json:"codec"`
+	WS_Channels	int		`json:"channels"`
+}
+
+// VideoChapterは動画のチャプターを定義します。
+type VideoChapter struct {
+	WS_Title		string	`json:"title"`
+	WS_Start		float64	`json:"start"`		// 始まる位置（秒）
+	WS_StartText	string	`json:"startText"`	// "1:02:03"
+	WS_Percent		float64	`json:"percent"`	// 動画全体に対する位置（%）
+}
+
+// AudioTemplateDataは音声プレイヤーのテンプレートに渡されるデータを定義します。
+// フォルダーをアルバムとみなし、同じフォルダーの音声ファイルを順番に再生します。
+type AudioTemplateData struct {
+	WS_Title		string			`json:"title"`
+	WS_Album		string			`json:"album"`				// アルバム名（タグが無いときはフォルダー名）
+	WS_Cover		string			`json:"cover,omitempty"`		// アルバムのカバー画像のURL
+	WS_BaseURL		template.URL	`json:"baseURL"`
+	WS_CurrentIndex	int				`json:"currentIndex"`
+	WS_Tracks		[]AlbumTrack	`json:"tracks"`
+}
+
+// AlbumTrackはアルバムの1曲を定義します。リンクはフォルダーからの相対パスです。
+type AlbumTrack struct {
+	WS_Name			string	`json:"name"`
+	WS_Link			string	`json:"link"`						// 音声ファイル
+	WS_Page			string	`json:"page"`						// .audio.html
+	WS_Title		string	`json:"title"`						// タグが無いときはファイル名
+	WS_Artist		string	`json:"artist,omitempty"`
+	WS_Album		string	`json:"album,omitempty"`
+	WS_TrackNo		string	`json:"trackNo,omitempty"`
+	WS_Duration		float64	`json:"duration,omitempty"`		// 長さ（秒）
+	WS_DurationText	string	`json:"durationText,omitempty"`
+	WS_Cover		string	`json:"cover,omitempty"`
+	WS_Transcoded	bool	`json:"transcoded"`				// 変換しながら送信する（?t=秒で途中から再生する）
+}
+
+// PlaylistTemplateDataはプレイリスト（.m3u・.m3u8）のテンプレートに渡されるデータを定義します。
+type PlaylistTemplateData struct {
+	WS_Title	string			`json:"title"`
+	WS_BaseURL	template.URL	`json:"baseURL"`
+	WS_Entries	[]PlaylistEntry	`json:"entries"`
+}
+
+// PlaylistEntryはプレイリストの1項目を定義します。リンクはサーバーの絶対パスか、インターネット上のURLです。
+type PlaylistEntry struct {
+	WS_Title	string	`json:"title"`
+	WS_Link		string	`json:"link,omitempty"`		// 動画・音声ファイル（見つからないときは空）
+	WS_Page		string	`json:"page,omitempty"`		// .movie.html・.audio.html
+	WS_Duration	string	`json:"duration,omitempty"`
+	WS_IsAudio	bool	`json:"isAudio"`
+	WS_Missing	bool	`json:"missing"`				// ファイルが見つからない
+}
+
+// SubtitleTrackは動画の字幕（<track>）を定義します。
+type SubtitleTrack struct {
+	WS_Link		string	`json:"link"`		// WebVTTに変換した字幕のURL
+	WS_Label	string	`json:"label"`		// 表示名（言語名や字幕のタイトル）
+	WS_Lang		string	`json:"lang"`		// 言語タグ（分からないときは空）
+	WS_Default	bool	`json:"default"`	// 最初から表示する
+}
+
+// FileInfoDataはAPIで返すファイルのメタデータを定義します。
+type FileInfoData struct {
+	WS_Name			string	`json:"name"`
+	WS_Link			string	`json:"link"`
+	WS_Size			int64	`json:"size"`
+	WS_LastMod		string	`json:"lastModified"`
+	WS_MimeType		string	`json:"mimeType,omitempty"`
+	WS_IsDirectory	bool	`json:"isDirectory"`
+	WS_IsMovie		bool	`json:"isMovie"`
+	WS_IsAudio		bool	`json:"isAudio"`
+	WS_IsImage		bool	`json:"isImage"`
+	WS_Width		int		`json:"width,omitempty"`
+	WS_Height		int		`json:"height,omitempty"`
 }
 
 // getRequestedPathはセキュリティ上の問題を防止するために、リクエストされたパスを正規化します。
@@ -88,6 +290,24 @@ func getRequestedPath(r *http.Request) string {
 	return path
 }
 
+// escapeURLPathはルートフォルダーからのパスを、/を残したままURLエンコードします。
+func escapeURLPath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// IsAudioFileはファイルが音声ファイルであるかどうかをチェックします。
+func IsAudioFile(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp3", ".m4a", ".aac", ".flac", ".ogg", ".oga", ".opus", ".wav", ".wma", ".ape", ".aif", ".aiff", ".wv":
+		return true
+	}
+	return false
+}
+
 // IsMovieFileはファイルが動画ファイルであるかどうかをチェックします。
 func IsMovieFile(path string) bool {
 	ext := strings.ToLower(filepath.Ext(path))
@@ -0,0 +1,306 @@
+// Functions/hls.go:HLSストリーミング:Functions/hls.go
+//
+// 変換が必要な動画をHLSで配信する
+//	/hls/<パス>/master.m3u8			画質ごとのプレイリストの一覧
+//	/hls/<パス>/<画質>/index.m3u8	セグメントの一覧（動画全体）
+//	/hls/<パス>/<画質>/<番号>.ts		セグメント
+//
+// セグメントはリクエストされたときにffmpegで作成し、作業用フォルダーのhls/にキャッシュする
+// プレイリストには最初から全てのセグメントが載っているので、どこにでもシークできる
+//
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HLSのデフォルト値
+const (
+	defaultHLSSegmentSeconds	= 6
+	defaultHLSCacheSize			= 4096	// MB
+)
+
+// 画質の設定が無いときに使う画質
+var defaultHLSRenditions = []HLSRendition{
+	{Name: "1080p", Height: 1080, VideoBitrate: 5000, AudioBitrate: 192},
+	{Name: "720p", Height: 720, VideoBitrate: 2800, AudioBitrate: 128},
+	{Name: "480p", Height: 480, VideoBitrate: 1400, AudioBitrate: 128},
+}
+
+var (
+	hlsCacheOnce	sync.Once
+	hlsCache		*diskCache
+)
+
+// getHLSCacheはセグメント用のキャッシュを返します。
+func getHLSCache(config *ServerConfig) *diskCache {
+	hlsCacheOnce.Do(func() {
+		maxSize := config.Config.HLS.CacheSize
+		if maxSize <= 0 {
+			maxSize = defaultHLSCacheSize
+		}
+		hlsCache = newDiskCache(filepath.Join(config.Config.Temporary, "hls"), maxSize*1024*1024)
+	})
+	return hlsCache
+}
+
+// hlsSegmentSecondsはセグメントの長さ（秒）を返します。
+func hlsSegmentSeconds(config *ServerConfig) int {
+	if config.Config.HLS.SegmentSeconds > 0 {
+		return config.Config.HLS.SegmentSeconds
+	}
+	return defaultHLSSegmentSeconds
+}
+
+// hlsRenditionsは設定ファイルの画質の一覧を返します。
+func hlsRenditions(config *ServerConfig) []HLSRendition {
+	if len(config.Config.HLS.Renditions) > 0 {
+		return config.Config.HLS.Renditions
+	}
+	return defaultHLSRenditions
+}
+
+// useHLSは動画ページでHLSを使うかどうかを返します。
+// ffprobeで調べて映像をそのままコピーできる（入れ物を変えるだけの）ときは、HLSにせずにMP4に変えながら送信します。
+// ?mode=hlsまたは?mode=directで、リクエストごとに指定できます。
+func useHLS(r *http.Request, filePath string, info os.FileInfo, config *ServerConfig) bool {
+	switch r.URL.Query().Get("mode") {
+	case "hls":
+		return true
+	case "direct":
+		return false
+	}
+	if !config.Config.HLS.Enabled || !needsTranscode(filePath) {
+		return false
+	}
+	profileName, profile := transcodeProfile(r, config)
+	return !planTranscode(r.Context(), filePath, info, profileName, profile, config).copyVideo
+}
+
+// needsTranscodeはブラウザーでそのまま再生できず、変換が必要な動画かどうかを返します。
+func needsTranscode(filePath string) bool {
+	ext := strings.ToLower(filepath.Ext(filePath))
+	return ext != ".mp4" && ext != ".webm"
+}
+
+// HandleHLSRequestはHLSのプレイリストとセグメントを返します。
+func HandleHLSRequest(resolvedFolders map[string]string, config *ServerConfig, err404Tmpl *template.Template) http.HandlerFunc {
+	paths := newPathResolver(resolvedFolders, config)
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestedPath := strings.TrimPrefix(getRequestedPath(r), "hls/")
+
+		// 最後の部分から、動画のパスとリクエストの種類を取り出す
+		pathParts := strings.Split(requestedPath, "/")
+		last := pathParts[len(pathParts)-1]
+		var moviePath, renditionName string
+		switch {
+		case last == "master.m3u8" && len(pathParts) >= 2:
+			moviePath = strings.Join(pathParts[:len(pathParts)-1], "/")
+		case len(pathParts) >= 3:
+			moviePath = strings.Join(pathParts[:len(pathParts)-2], "/")
+			renditionName = pathParts[len(pathParts)-2]
+		}
+
+		// 動画ファイルのフルパスを得る
+		fullPath, info, ok := paths.resolveFile(moviePath)
+		if !ok || !IsMovieFile(fullPath) {
+			log.Printf("HLS: 404: '%s'", requestedPath)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusNotFound)
+			err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
+			return
+		}
+
+		probe, err := probeMovie(r.Context(), fullPath, info, config)
+		if err != nil {
+			log.Printf("HLS: 動画の情報取得に失敗しました: '%s' %v", fullPath, err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		// HLSの画質は設定ファイルのプロファイル（?profile=は使わない）で変換する
+		profileName, profile := transcodeProfile(nil, config)
+
+		// マスタープレイリスト
+		if renditionName == "" {
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			w.Header().Set("Cache-Control", "no-cache")
+			io.WriteString(w, hlsMasterPlaylist(probe, profile, config))
+			return
+		}
+
+		var rendition HLSRendition
+		found := false
+		for _, rd := range hlsRenditions(config) {
+			if rd.Name == renditionName {
+				rendition, found = rd, true
+				break
+			}
+		}
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+
+		// 画質ごとのプレイリスト
+		if last == "index.m3u8" {
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			w.Header().Set("Cache-Control", "no-cache")
+			io.WriteString(w, hlsMediaPlaylist(probe.duration(), hlsSegmentSeconds(config)))
+			return
+		}
+
+		// セグメント
+		index, err := strconv.Atoi(strings.TrimSuffix(last, ".ts"))
+		segmentSeconds := hlsSegmentSeconds(config)
+		if !strings.HasSuffix(last, ".ts") || err != nil || index < 0 || float64(index*segmentSeconds) >= probe.duration() {
+			http.NotFound(w, r)
+			return
+		}
+		plan := transcodePlan{profileName: profileName, profile: profile}
+		key := cacheKey(fullPath, info, fmt.Sprintf("hls:%s:%d:%d:%d:%d:%s", rendition.Name, rendition.Height, rendition.VideoBitrate, segmentSeconds, index, plan.variant()))
+		// 作成は同じセグメントを待っている全てのリクエストで共有するので、r.Context()ではなくctxを使う
+		cachedPath, release, err := getHLSCache(config).getOrCreate(r.Context(), key+".ts", func(ctx context.Context, out io.Writer) error {
+			release, err := getTranscodeLimiter(config).acquire(ctx, "hls", fullPath)
+			if err != nil {
+				return err
+			}
+			defer release()
+			log.Printf("HLS: セグメントの作成: '%s' %s #%d", fullPath, rendition.Name, index)
+			return transcodeHLSSegment(ctx, out, fullPath, probe, rendition, profile, index, segmentSeconds)
+		})
+		if err != nil {
+			switch {
+			case errors.Is(err, errTranscodeBusy):
+				w.Header().Set("Retry-After", "10")
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			case r.Context().Err() != nil:
+				log.Printf("HLS: 接続が切れたためセグメントの作成を中止しました: '%s' #%d", fullPath, index)
+			default:
+				log.Printf("HLS: セグメントの作成に失敗しました: '%s' %v", fullPath, err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			}
+			return
+		}
+		defer release()
+		w.Header().Set("Content-Type", "video/mp2t")
+		http.ServeFile(w, r, cachedPath)
+	}
+}
+
+// hlsMasterPlaylistは元の動画とプロファイルのmaxHeightより大きくならない画質を並べたマスタープレイリストを返します。
+func hlsMasterPlaylist(probe *movieProbe, profile TranscodeProfile, config *ServerConfig) string {
+	video, _ := probe.videoStream()
+	maxHeight := hlsMaxHeight(video, profile)
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	written := 0
+	renditions := hlsRenditions(config)
+	for i, rd := range renditions {
+		// 元の動画より大きい画質は作らない（ただし最低1つは載せる）
+		if maxHeight > 0 && rd.Height > maxHeight && !(written == 0 && i == len(renditions)-1) {
+			continue
+		}
+		bandwidth := (rd.VideoBitrate + rd.AudioBitrate) * 1000
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d", bandwidth)
+		if video.Width > 0 && video.Height > 0 {
+			height := min(rd.Height, maxHeight)
+			width := (video.Width*height/video.Height + 1) / 2 * 2
+			fmt.Fprintf(&b, ",RESOLUTION=%dx%d", width, height)
+		}
+		fmt.Fprintf(&b, ",NAME=\"%s\"\n%s/index.m3u8\n", rd.Name, rd.Name)
+		written++
+	}
+	return b.String()
+}
+
+// hlsMaxHeightは、元の動画の大きさとプロファイルのmaxHeightのうち小さい方を返します。どちらも分からないときは0です。
+func hlsMaxHeight(video probeStream, profile TranscodeProfile) int {
+	maxHeight := video.Height
+	if profile.MaxHeight > 0 && (maxHeight <= 0 || profile.MaxHeight < maxHeight) {
+		maxHeight = profile.MaxHeight
+	}
+	return maxHeight
+}
+
+// hlsMediaPlaylistは動画全体のセグメントを並べたVODプレイリストを返します。
+func hlsMediaPlaylist(duration float64, segmentSeconds int) string {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", segmentSeconds)
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	for i := 0; float64(i*segmentSeconds) < duration; i++ {
+		length := min(float64(segmentSeconds), duration-float64(i*segmentSeconds))
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%d.ts\n", length, i)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String()
+}
+
+// transcodeHLSSegmentはffmpegで1つのセグメントを作成し、outに書き出します。
+// タイムスタンプは動画の先頭からの時間にするので、セグメントをつなげても途切れません。
+// エンコーダー・プリセット・CRFはプロファイルに従い、ビットレートは画質ごとの値を上限にします。
+func transcodeHLSSegment(ctx context.Context, out io.Writer, filePath string, probe *movieProbe, rendition HLSRendition, profile TranscodeProfile, index int, segmentSeconds int) error {
+	start := strconv.Itoa(index * segmentSeconds)
+	height := rendition.Height
+	if profile.MaxHeight > 0 {
+		height = min(height, profile.MaxHeight)
+	}
+	args := []string{
+		"-v", "error",
+		"-ss", start,
+		"-i", filePath,
+		"-t", strconv.Itoa(segmentSeconds),
+		"-map", "0:v:0",
+		"-vf", fmt.Sprintf("scale=-2:'min(%d,ih)'", height),
+		"-c:v", profile.VideoCodec,
+		"-preset", profile.Preset,
+		"-crf", strconv.Itoa(*profile.CRF),
+		"-pix_fmt", "yuv420p",
+		"-maxrate", fmt.Sprintf("%dk", rendition.VideoBitrate),
+		"-bufsize", fmt.Sprintf("%dk", rendition.VideoBitrate*2),
+		// キーフレームはセグメントの先頭だけ（全てのフレームをキーフレームにすると画質が落ちる）
+		"-force_key_frames", "expr:eq(n,0)",
+	}
+	if video, ok := probe.videoStream(); ok && video.frameRate() > 0 {
+		args = append(args, "-g", strconv.Itoa(int(math.Ceil(video.frameRate()*float64(segmentSeconds)))))
+	}
+	if _, ok := probe.audioStream(); ok {
+		args = append(args,
+			"-map", "0:a:0",
+			"-c:a", profile.AudioCodec,
+			"-b:a", fmt.Sprintf("%dk", rendition.AudioBitrate),
+			"-ac", "2")
+	}
+	args = append(args,
+		"-output_ts_offset", start,
+		"-muxdelay", "0",
+		"-f", "mpegts",
+		"pipe:1")
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stdout = out
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpegコマンド実行失敗: %w %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -1,21 +1,23 @@
-// Functions/common.go:共通関数と構造体:Functions/common.go
+// Functions/icon.go:アイコンハンドラ:Functions/icon.go
+//
+// <パス>.icon と /icon/<パス> で、ファイルやフォルダーのアイコン画像を返す
+// アイコンの取得方法は iconprovider.go を、キャッシュとスプライトは iconcache.go を参照
+//
 
 package internal
 
 import (
-	"encoding/base64"
-	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 )
 
 // HandleIconRequestは`.icon`リクエストを処理してアイコン画像を返します。
 func HandleIconRequest(resolvedFolders map[string]string, config *ServerConfig, err404Tmpl *template.Template) http.HandlerFunc {
+	paths := newPathResolver(resolvedFolders, config)
 	return func(w http.ResponseWriter, r *http.Request) {
 		requestedPath := getRequestedPath(r)
 
@@ -23,14 +25,14 @@ func HandleIconRequest(resolvedFolders map[string]string, config *ServerConfig,
 		if strings.HasSuffix(requestedPath, ".icon") {
 			// .iconを取り除いて元のファイルパスを取得
 			originalPath := strings.TrimSuffix(requestedPath, ".icon")
-			handleIconFile(w, r, originalPath, resolvedFolders, config, err404Tmpl)
+			handleIconFile(w, r, originalPath, paths, config, err404Tmpl)
 			return
 		}
 
 		// `/icon/`で始まるリクエストを処理
 		if strings.HasPrefix(r.URL.Path, "/icon/") {
 			requestedPath = strings.TrimPrefix(r.URL.Path, "/icon/")
-			handleIconFile(w, r, requestedPath, resolvedFolders, config, err404Tmpl)
+			handleIconFile(w, r, requestedPath, paths, config, err404Tmpl)
 			return
 		}
 
@@ -41,23 +43,26 @@ func HandleIconRequest(resolvedFolders map[string]string, config *ServerConfig,
 }
 
 // handleIconFileは、指定されたパスのアイコンを返します。
-func handleIconFile(w http.ResponseWriter, r *http.Request, originalPath string, resolvedFolders map[string]string, config *ServerConfig, err404Tmpl *template.Template) {
-	var fullPath string
-	pathParts := strings.Split(originalPath, string(os.PathSeparator))
-	firstFolder := pathParts[0]
+func handleIconFile(w http.ResponseWriter, r *http.Request, originalPath string, paths pathResolver, config *ServerConfig, err404Tmpl *template.Template) {
+	if target, ok := paths.resolve(originalPath); ok {
+		fullPath := target.fullPath
 
-	if resolvedPath, ok := resolvedFolders[firstFolder]; ok {
-		fullPath = resolvedPath
-		if len(pathParts) > 1 {
-			subPath := filepath.Join(pathParts[1:]...)
-			fullPath = filepath.Join(resolvedPath, subPath)
+		// アーカイブの中の項目は、フォルダーならアーカイブが置かれているフォルダーの、ファイルならアーカイブのアイコンを使う
+		if target.kind == pathInArchive {
+			fullPath = target.archivePath
+			if archive, err := openVirtualArchive(target.archivePath); err == nil {
+				if entry, ok := archive.stat(target.inner); ok && entry.isDir {
+					fullPath = filepath.Dir(target.archivePath)
+				}
+				archive.Close()
+			}
 		}
 
 		// パスが存在し、それがファイルまたはフォルダーであることを確認
 		info, err := os.Stat(fullPath)
 		if err == nil && (info.Mode().IsRegular() || info.IsDir()) {
-			// getIconツールを実行してBase64データを取得
-			base64Data, err := getIconBase64(fullPath)
+			// 設定された方法でアイコンを取得（取得済みのものはキャッシュから）
+			icon, _, err := loadIcon(fullPath, info, config)
 			if err != nil {
 				log.Printf("アイコンの取得に失敗しました: %v", err)
 				w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -66,17 +71,7 @@ func handleIconFile(w http.ResponseWriter, r *http.Request, originalPath string,
 				return
 			}
 
-			// image/pngとしてデータを返す
-			w.Header().Set("Content-Type", "image/png")
-			data, err := base64.StdEncoding.DecodeString(base64Data)
-			if err != nil {
-				log.Printf("Base64のデコードに失敗しました: %v", err)
-				w.Header().Set("Content-Type", "text/html; charset=utf-8")
-				w.WriteHeader(http.StatusInternalServerError)
-				err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
-				return
-			}
-			w.Write(data)
+			serveIcon(w, r, icon)
 			return
 		}
 	}
@@ -86,13 +81,3 @@ func handleIconFile(w http.ResponseWriter, r *http.Request, originalPath string,
 	w.WriteHeader(http.StatusNotFound)
 	err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
 }
-
-// getIconBase64は、getIconツールを実行してBase64エンコードされたPNGを返します。
-func getIconBase64(filePath string) (string, error) {
-	cmd := exec.Command("./Libraries/getIcon", filePath)
-	output, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("failed to get icon for %s: %v", filePath, err)
-	}
-	return strings.TrimSpace(string(output)), nil
-}
@@ -0,0 +1,150 @@
+// Functions/iconcache.go:アイコンのキャッシュとスプライト:Functions/iconcache.go
+//
+// 取得したアイコンはメモリーに保存し、ETagと長めのCache-Controlを付けて送信する
+// 種類で決まるアイコン（組み込み・アイコンテーマ）は種類ごとに、ファイルごとに違うアイコン（getIcon）はパスと更新日時ごとに保存する
+// icon.spriteが有効なときは、フォルダーの全てのアイコンを folder/?icons=css の1つのCSSにまとめて送信する
+//
+
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// アイコンのキャッシュに関する値
+const (
+	iconCacheEntries	= 4096				// メモリーに保存するアイコンの数
+	iconMaxAge			= 7 * 24 * 60 * 60	// ブラウザーにキャッシュさせる時間（秒）
+)
+
+// cachedIconはメモリーに保存したアイコンです。
+type cachedIcon struct {
+	data		[]byte
+	contentType	string
+	etag		string
+}
+
+var (
+	iconCacheMu	sync.Mutex
+	iconCache	= make(map[string]cachedIcon)
+)
+
+// loadIconはアイコンを返します。キャッシュに無いときは取得して保存します。
+// 2つ目の戻り値は、アイコンのキャッシュのキーです。
+func loadIcon(fullPath string, info os.FileInfo, config *ServerConfig) (cachedIcon, string, error) {
+	provider := getIconProvider(config)
+	size := iconSize(config)
+	key := provider.iconKey(fullPath, info, size)
+
+	iconCacheMu.Lock()
+	icon, ok := iconCache[key]
+	iconCacheMu.Unlock()
+	if ok {
+		return icon, key, nil
+	}
+
+	data, contentType, err := provider.icon(fullPath, info, size)
+	if err != nil {
+		return cachedIcon{}, key, err
+	}
+	sum := sha256.Sum256(data)
+	icon = cachedIcon{data: data, contentType: contentType, etag: `"` + hex.EncodeToString(sum[:16]) + `"`}
+
+	iconCacheMu.Lock()
+	// いっぱいになったら、まとめて捨てて作り直す
+	if len(iconCache) >= iconCacheEntries {
+		iconCache = make(map[string]cachedIcon)
+	}
+	iconCache[key] = icon
+	iconCacheMu.Unlock()
+	return icon, key, nil
+}
+
+// serveIconはアイコンをETagとCache-Controlを付けて送信します。If-None-Matchが一致するときは304を返します。
+func serveIcon(w http.ResponseWriter, r *http.Request, icon cachedIcon) {
+	w.Header().Set("Content-Type", icon.contentType)
+	w.Header().Set("ETag", icon.etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", iconMaxAge))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(icon.data))
+}
+
+// iconClassはアイコンのキャッシュのキーから、スプライトのCSSのクラス名を作ります。
+func iconClass(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "ic-" + hex.EncodeToString(sum[:6])
+}
+
+// iconClassForはフォルダーの項目のアイコンの、スプライトのCSSのクラス名を返します。
+func iconClassFor(entryPath string, config *ServerConfig) string {
+	info, err := os.Stat(entryPath)
+	if err != nil {
+		return ""
+	}
+	return iconClass(getIconProvider(config).iconKey(entryPath, info, iconSize(config)))
+}
+
+// useIconSpriteは、フォルダーのアイコンを1つのCSSにまとめて送るかどうかを返します。
+func useIconSprite(config *ServerConfig) bool {
+	return config.Config.Icon.Sprite
+}
+
+// handleFolderIconCSSはフォルダーの全ての項目のアイコンを、data URIの背景画像にしたCSSで送信します。
+// 同じアイコンは1つのクラスにまとめるので、同じ種類のファイルがたくさんあっても小さくなります。
+func handleFolderIconCSS(w http.ResponseWriter, r *http.Request, fullPath string, config *ServerConfig) {
+	entries, err := os.ReadDir(fullPath)
+	if err != nil {
+		log.Printf("Icon: フォルダの読み込みに失敗しました: '%s' %v", fullPath, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	rules := make(map[string]string)
+	for _, entry := range entries {
+		if ignored, _ := isIgnored(entry.Name(), config.Ignores); ignored {
+			continue
+		}
+		entryPath := filepath.Join(fullPath, entry.Name())
+		info, err := os.Stat(entryPath)
+		if err != nil {
+			continue
+		}
+		icon, key, err := loadIcon(entryPath, info, config)
+		if err != nil {
+			log.Printf("Icon: アイコンの取得に失敗しました: %v", err)
+			continue
+		}
+		class := iconClass(key)
+		if _, ok := rules[class]; !ok {
+			rules[class] = fmt.Sprintf(".%s{background-image:url(\"data:%s;base64,%s\")}\n", class, icon.contentType, base64.StdEncoding.EncodeToString(icon.data))
+		}
+	}
+
+	// 同じ内容なら同じETagになるように、クラス名の順に並べる
+	classes := make([]string, 0, len(rules))
+	for class := range rules {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	var css strings.Builder
+	for _, class := range classes {
+		css.WriteString(rules[class])
+	}
+
+	sum := sha256.Sum256([]byte(css.String()))
+	w.Header().Set("Content-Type", "text/css; charset=utf-8")
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "", time.Time{}, strings.NewReader(css.String()))
+}
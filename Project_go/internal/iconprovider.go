@@ -0,0 +1,311 @@
+// Functions/iconprovider.go:アイコンの取得方法:Functions/iconprovider.go
+//
+// ファイルやフォルダーのアイコンは、設定ファイルのicon.providerで選んだ方法で取得する
+//	builtin		組み込みのSVGアイコン（ファイルの種類ごと）。どのOSでも使える
+//	theme		freedesktopのアイコンテーマのフォルダー（/usr/share/icons/Adwaitaなど）
+//	getIcon		macOSのFinderと同じアイコンを取り出すgetIconツール
+//	auto		使えるものを上から順に試す（macOSならgetIcon、themeDirがあればtheme、最後にbuiltin）
+// 取得できなかったときは、組み込みのアイコンを使う
+//
+
+package internal
+
+import (
+	"context"
+	"embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// アイコンのデフォルト値
+const (
+	defaultIconSize		= 24
+	defaultGetIconPath	= "./Libraries/getIcon"
+)
+
+// iconProviderはファイルやフォルダーのアイコン画像を返すインターフェースです。
+type iconProvider interface {
+	// iconは画像のデータとContent-Typeを返します。
+	icon(fullPath string, info os.FileInfo, size int) ([]byte, string, error)
+	// iconKeyは同じアイコンになるものが同じ値になる、キャッシュのキーを返します。
+	iconKey(fullPath string, info os.FileInfo, size int) string
+}
+
+var (
+	iconProviderOnce	sync.Once
+	iconProviderInst	iconProvider
+)
+
+// getIconProviderは設定ファイルで選ばれたアイコンの取得方法を返します。
+func getIconProvider(config *ServerConfig) iconProvider {
+	iconProviderOnce.Do(func() {
+		iconProviderInst = newIconProvider(config)
+	})
+	return iconProviderInst
+}
+
+// newIconProviderは設定に合わせて、アイコンを取得する方法を順に試すiconChainを作ります。
+func newIconProvider(config *ServerConfig) iconProvider {
+	settings := config.Config.Icon
+	getIconPath := settings.GetIcon
+	if getIconPath == "" {
+		getIconPath = defaultGetIconPath
+	}
+
+	var chain iconChain
+	switch settings.Provider {
+	case "builtin":
+	case "theme":
+		if settings.ThemeDir == "" {
+			log.Printf("Icon: themeDirが設定されていないため、組み込みのアイコンを使います")
+		} else {
+			chain = append(chain, newThemeIcons(settings.ThemeDir))
+		}
+	case "getIcon":
+		chain = append(chain, getIconTool{path: getIconPath, cache: getImageCache(config)})
+	case "", "auto":
+		if _, err := os.Stat(getIconPath); err == nil && runtime.GOOS == "darwin" {
+			chain = append(chain, getIconTool{path: getIconPath, cache: getImageCache(config)})
+		}
+		if settings.ThemeDir != "" {
+			chain = append(chain, newThemeIcons(settings.ThemeDir))
+		}
+	default:
+		log.Printf("Icon: 不明なprovider '%s' のため、組み込みのアイコンを使います", settings.Provider)
+	}
+	chain = append(chain, builtinIcons{})
+	return chain
+}
+
+// iconSizeは設定ファイルからアイコンの大きさを返します。未設定のときはデフォルト値を返します。
+func iconSize(config *ServerConfig) int {
+	if size := config.Config.Icon.Size; size > 0 {
+		return size
+	}
+	return defaultIconSize
+}
+
+// iconChainは登録された順にアイコンの取得を試します。
+type iconChain []iconProvider
+
+func (c iconChain) icon(fullPath string, info os.FileInfo, size int) ([]byte, string, error) {
+	var errs []error
+	for _, provider := range c {
+		data, contentType, err := provider.icon(fullPath, info, size)
+		if err == nil {
+			return data, contentType, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, "", errors.Join(errs...)
+}
+
+// 取得できなかったときの組み込みのアイコンは、最初の方法のキーで保存する
+func (c iconChain) iconKey(fullPath string, info os.FileInfo, size int) string {
+	return c[0].iconKey(fullPath, info, size)
+}
+
+// iconCategoryはアイコンを選ぶための、ファイルの種類を返します。
+func iconCategory(fullPath string, info os.FileInfo) string {
+	if info.IsDir() {
+		return "folder"
+	}
+	ext := strings.ToLower(filepath.Ext(fullPath))
+	switch {
+	case isBrowsableArchive(fullPath):
+		return "archive"
+	case IsMovieFile(fullPath):
+		return "video"
+	case IsAudioFile(fullPath) || isPlaylistFile(fullPath):
+		return "audio"
+	case isImageFile(fullPath):
+		return "image"
+	}
+	switch ext {
+	case ".gz", ".tgz", ".bz2", ".xz", ".7z", ".rar", ".lzh", ".dmg", ".iso":
+		return "archive"
+	case ".pdf":
+		return "pdf"
+	case ".doc", ".docx", ".odt", ".rtf", ".pages":
+		return "document"
+	case ".xls", ".xlsx", ".ods", ".csv", ".tsv", ".numbers":
+		return "spreadsheet"
+	case ".ppt", ".pptx", ".odp", ".key":
+		return "presentation"
+	case ".go", ".c", ".h", ".cpp", ".hpp", ".m", ".swift", ".java", ".kt", ".js", ".ts", ".py", ".rb", ".php", ".rs", ".sh", ".json", ".xml", ".yaml", ".yml", ".html", ".css":
+		return "code"
+	case ".md", ".txt", ".log", ".srt", ".ass", ".vtt":
+		return "text"
+	}
+	if strings.HasPrefix(mime.TypeByExtension(ext), "text/") {
+		return "text"
+	}
+	return "file"
+}
+
+//go:embed icons/*.svg
+var builtinIconFS embed.FS
+
+// builtinIconsは組み込みのSVGアイコンを返します。SVGなので大きさは指定しません。
+type builtinIcons struct{}
+
+func (builtinIcons) icon(fullPath string, info os.FileInfo, size int) ([]byte, string, error) {
+	data, err := builtinIconFS.ReadFile("icons/" + iconCategory(fullPath, info) + ".svg")
+	if err != nil {
+		return nil, "", err
+	}
+	return data, "image/svg+xml", nil
+}
+
+func (builtinIcons) iconKey(fullPath string, info os.FileInfo, size int) string {
+	return "builtin:" + iconCategory(fullPath, info)
+}
+
+// themeIconsはfreedesktopのアイコンテーマのフォルダーからアイコンを探します。
+// 見つけたファイルのパスは覚えておき、次からは探しません。
+type themeIcons struct {
+	dir		string
+	mu		sync.Mutex
+	found	map[string]string	// "アイコン名:大きさ"と見つけたファイルのパス（見つからなかったときは空）
+}
+
+// newThemeIconsはアイコンテーマのフォルダーからアイコンを探すthemeIconsを作ります。
+func newThemeIcons(dir string) *themeIcons {
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		log.Printf("Icon: アイコンテーマのフォルダーが見つかりません: '%s'", dir)
+	}
+	return &themeIcons{dir: dir, found: make(map[string]string)}
+}
+
+func (t *themeIcons) icon(fullPath string, info os.FileInfo, size int) ([]byte, string, error) {
+	context, names := themeIconNames(fullPath, info)
+	for _, name := range names {
+		if iconPath := t.lookup(context, name, size); iconPath != "" {
+			data, err := os.ReadFile(iconPath)
+			if err != nil {
+				return nil, "", err
+			}
+			contentType := "image/png"
+			if strings.HasSuffix(iconPath, ".svg") {
+				contentType = "image/svg+xml"
+			}
+			return data, contentType, nil
+		}
+	}
+	return nil, "", fmt.Errorf("アイコンテーマに '%s' がありません", strings.Join(names, "', '"))
+}
+
+func (t *themeIcons) iconKey(fullPath string, info os.FileInfo, size int) string {
+	context, names := themeIconNames(fullPath, info)
+	return "theme:" + context + "/" + strings.Join(names, ",") + ":" + strconv.Itoa(size)
+}
+
+// lookupはアイコンテーマの中から、大きさの近いアイコンのファイルを探します。
+func (t *themeIcons) lookup(context string, name string, size int) string {
+	key := name + ":" + strconv.Itoa(size)
+	t.mu.Lock()
+	iconPath, ok := t.found[key]
+	t.mu.Unlock()
+	if ok {
+		return iconPath
+	}
+
+	// 指定の大きさ、大きいもの、小さいもの、SVGの順に探す
+	var candidates []string
+	for _, s := range []int{size, size * 2, 32, 48, 64, 128, 256, 24, 22, 16} {
+		dim := strconv.Itoa(s)
+		candidates = append(candidates,
+			filepath.Join(t.dir, dim+"x"+dim, context, name+".png"),	// hicolor・Adwaitaなど
+			filepath.Join(t.dir, context, dim, name+".svg"),			// elementaryなど
+			filepath.Join(t.dir, context, dim, name+".png"))
+	}
+	candidates = append(candidates,
+		filepath.Join(t.dir, "scalable", context, name+".svg"),
+		filepath.Join(t.dir, context, "scalable", name+".svg"))
+
+	iconPath = ""
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && info.Mode().IsRegular() {
+			iconPath = candidate
+			break
+		}
+	}
+	t.mu.Lock()
+	t.found[key] = iconPath
+	t.mu.Unlock()
+	return iconPath
+}
+
+// themeIconNamesはアイコンテーマで探すフォルダー（places・mimetypes）と、アイコン名の候補を返します。
+// MIMEタイプから作った名前（image/jpeg→image-jpeg）、種類ごとの名前の順に探します。
+func themeIconNames(fullPath string, info os.FileInfo) (string, []string) {
+	category := iconCategory(fullPath, info)
+	if category == "folder" {
+		return "places", []string{"folder"}
+	}
+
+	var names []string
+	if mimeType, _, _ := strings.Cut(mime.TypeByExtension(filepath.Ext(fullPath)), ";"); mimeType != "" {
+		names = append(names, strings.ReplaceAll(mimeType, "/", "-"))
+	}
+	switch category {
+	case "archive":
+		names = append(names, "package-x-generic")
+	case "video", "audio", "image", "text":
+		names = append(names, category+"-x-generic")
+	case "code":
+		names = append(names, "text-x-script", "text-x-generic")
+	case "pdf":
+		names = append(names, "application-pdf")
+	case "document", "spreadsheet", "presentation":
+		names = append(names, "x-office-"+category)
+	}
+	return "mimetypes", append(names, "application-x-generic", "unknown")
+}
+
+// getIconToolはmacOSのgetIconツールで、Finderと同じアイコンを取り出します。
+// ファイルごとにアイコンが違うので、取り出したアイコンはパスと更新日時ごとにディスクのキャッシュに保存します。
+type getIconTool struct {
+	path	string
+	cache	*diskCache
+}
+
+func (g getIconTool) icon(fullPath string, info os.FileInfo, size int) ([]byte, string, error) {
+	cachedPath, release, err := g.cache.getOrCreate(context.Background(), g.iconKey(fullPath, info, size)+".png", func(ctx context.Context, w io.Writer) error {
+		output, err := exec.Command(g.path, fullPath, strconv.Itoa(size)).Output()
+		if err != nil {
+			return fmt.Errorf("failed to get icon for %s: %v", fullPath, err)
+		}
+		// getIconはBase64でエンコードしたPNGを返す
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(output)))
+		if err != nil {
+			return fmt.Errorf("Base64のデコードに失敗しました: %v", err)
+		}
+		_, err = w.Write(data)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := os.ReadFile(cachedPath)
+	release()
+	if err != nil {
+		return nil, "", err
+	}
+	return data, "image/png", nil
+}
+
+func (g getIconTool) iconKey(fullPath string, info os.FileInfo, size int) string {
+	return cacheKey(fullPath, info, "icon:"+strconv.Itoa(size))
+}
@@ -3,27 +3,39 @@
 package internal
 
 import (
+	"context"
 	"html/template"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"io"
 
 	"fmt"
-	"os/exec"
-	"regexp"
+	"image"
+	_ "image/gif"	//GIFデコード用
+	"image/jpeg"	//JPEGデコード・エンコード用
+	"image/png"		//PNGデコード・エンコード用
 
-	"strconv"
-	"github.com/google/uuid"
+	xdraw "golang.org/x/image/draw"	//縮小処理用
+	_ "golang.org/x/image/webp"		//WebPデコード用
+)
 
+// 画像の縮小に関するデフォルト値
+const (
+	defaultImageMaxSize	= 2000	// この大きさを超える画像は縮小して送信する
+	defaultImageQuality	= 85	// JPEGで保存するときの品質
+	imageMaxPixels		= 100 * 1000 * 1000	// これより画素数の多い画像はデコードしない（メモリーを使い切らないように）
 )
 
 
 // HandleImageRequestは画像ビューアのHTMLを返します。
 func HandleImageRequest(resolvedFolders map[string]string, config *ServerConfig, imageTmpl *template.Template, imageR2LTmpl *template.Template, image360vrTmpl *template.Template, err404Tmpl *template.Template) http.HandlerFunc {
+	paths := newPathResolver(resolvedFolders, config)
 	return func(w http.ResponseWriter, r *http.Request) {
 		requestedPath := getRequestedPath(r)
 
@@ -31,22 +43,10 @@ func HandleImageRequest(resolvedFolders map[string]string, config *ServerConfig,
 		originalPath := strings.TrimSuffix(requestedPath, ".image.html")
 
 		// 許可されたルートフォルダを基に、完全なファイルパスを再構築
-		var fullPath string
-		pathParts := strings.Split(originalPath, string(os.PathSeparator))
-		firstFolder := pathParts[0]
-
-		if resolvedPath, ok := resolvedFolders[firstFolder]; ok {
-			fullPath = resolvedPath
-			if len(pathParts) > 1 {
-				subPath := filepath.Join(pathParts[1:]...)
-				fullPath = filepath.Join(resolvedPath, subPath)
-			}
-
-			info, err := os.Stat(fullPath)
-			if err == nil && info.Mode().IsRegular() && isImageFile(fullPath) {
+		if target, ok := paths.resolve(originalPath); ok && isImageFile(target.fullPath) {
+			if target.isFile() {
 				// 元の画像ファイルが存在する場合、テンプレートを返す
-				parentDir := filepath.Dir(fullPath)
-				dirEntries, err := os.ReadDir(parentDir)
+				imageData, err := buildImageData(r, target.fullPath, config)
 				if err != nil {
 					w.Header().Set("Content-Type", "text/html; charset=utf-8")
 					w.WriteHeader(http.StatusInternalServerError)
@@ -54,158 +54,239 @@ func HandleImageRequest(resolvedFolders map[string]string, config *ServerConfig,
 					return
 				}
 
-				var imageFileEntries []os.DirEntry
-				for _, entry := range dirEntries {
-					if !entry.IsDir() {
-						if ignored, reason := isIgnored(entry.Name(), config.Ignores); ignored {
-							log.Printf("Ignores Path: %s (Reason: %s)", filepath.Join(parentDir, entry.Name()), reason)
-							continue
-						}
-					}
-					if isImageFile(filepath.Join(parentDir, entry.Name())) {
-						imageFileEntries = append(imageFileEntries, entry)
-					}
+				executeImageTemplate(w, r, imageData, imageTmpl, imageR2LTmpl, image360vrTmpl, err404Tmpl)
+				return
+			}
+
+			// アーカイブの中の画像
+			if target.kind == pathInArchive {
+				imageData, err := buildArchiveImageData(r, target.archivePath, target.inner, config)
+				if err == nil {
+					executeImageTemplate(w, r, imageData, imageTmpl, imageR2LTmpl, image360vrTmpl, err404Tmpl)
+					return
 				}
+				log.Printf("Image: アーカイブ内の画像を表示できません: '%s' の '%s' %v", target.archivePath, target.inner, err)
+			}
+		}
 
-				_, errR2L	:= os.Stat(filepath.Join(parentDir, "__option_R2L__"))
-				_, err360vr	:= os.Stat(filepath.Join(parentDir, "__option_360VR__"))
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
+	}
+}
 
-				sort.Slice(imageFileEntries, func(i, j int) bool {
-					return imageFileEntries[i].Name() < imageFileEntries[j].Name()
-				})
+// executeImageTemplateは表示モードに合わせたテンプレートで画像ビューアを返します。
+func executeImageTemplate(w http.ResponseWriter, r *http.Request, imageData ImageData, imageTmpl *template.Template, imageR2LTmpl *template.Template, image360vrTmpl *template.Template, err404Tmpl *template.Template) {
+	// ページをめくったらしおりを送信する
+	folderPath := path.Dir(strings.TrimSuffix(getRequestedPath(r), ".image.html"))
+	imageData.WS_BookmarkLink = template.URL(apiPrefix + "bookmark/" + escapeURLPath(folderPath))
+	ensureViewerID(w, r)
+
+	tmpl := imageTmpl
+	switch imageData.WS_Mode {
+	case imageModeR2L:
+		tmpl = imageR2LTmpl
+	case imageMode360VR:
+		tmpl = image360vrTmpl
+	}
 
-				var imagePaths []string
-				currentIndex := -1
-				for idx, entry := range imageFileEntries {
-					imagePaths = append(imagePaths, url.PathEscape(entry.Name()))
-					if entry.Name() == filepath.Base(fullPath) {
-						currentIndex = idx
-					}
-				}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tmpl.Execute(w, imageData); err != nil {
+		log.Printf("テンプレートの実行に失敗しました: %v", err)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
+	}
+}
 
-				// WS_BaseURLはURLエンコードされたフォルダパスを返す
-				parentURL := filepath.Dir(r.URL.Path) + "/"
+// 画像ビューアの表示モード
+const (
+	imageModeNormal	= "normal"
+	imageModeR2L	= "R2L"		// __option_R2L__があるフォルダー
+	imageMode360VR	= "360VR"	// __option_360VR__があるフォルダー
+)
 
-				imageData := ImageData{
-					WS_Title:			template.URL(filepath.Base(fullPath)),
-					WS_Link:			template.URL(r.URL.Path),
-					WS_CurrentIndex:	currentIndex,
-					WS_ImagePaths:		imagePaths,
-					WS_ImageFile:		filepath.Base(fullPath),
-					WS_BaseURL:			template.URL(parentURL),
-				}
+// buildImageDataは同じフォルダーにある画像を集めて、画像ビューアに渡すデータを組み立てます。
+func buildImageData(r *http.Request, fullPath string, config *ServerConfig) (ImageData, error) {
+	parentDir := filepath.Dir(fullPath)
+	dirEntries, err := os.ReadDir(parentDir)
+	if err != nil {
+		return ImageData{}, err
+	}
 
-				w.Header().Set("Content-Type", "text/html; charset=utf-8")
-				if errR2L == nil {
-					if err := imageR2LTmpl.Execute(w, imageData); err != nil {
-						log.Printf("テンプレートの実行に失敗しました: %v", err)
-						w.Header().Set("Content-Type", "text/html; charset=utf-8")
-						w.WriteHeader(http.StatusInternalServerError)
-						err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
-					}
-				} else if err360vr == nil {
-					if err := image360vrTmpl.Execute(w, imageData); err != nil {
-						log.Printf("テンプレートの実行に失敗しました: %v", err)
-						w.Header().Set("Content-Type", "text/html; charset=utf-8")
-						w.WriteHeader(http.StatusInternalServerError)
-						err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
-					}
-				} else {
-					if err := imageTmpl.Execute(w, imageData); err != nil {
-						log.Printf("テンプレートの実行に失敗しました: %v", err)
-						w.Header().Set("Content-Type", "text/html; charset=utf-8")
-						w.WriteHeader(http.StatusInternalServerError)
-						err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
-					}
-				}
-				return
+	var imageFileEntries []sortItem
+	for _, entry := range dirEntries {
+		if !entry.IsDir() {
+			if ignored, reason := isIgnored(entry.Name(), config.Ignores); ignored {
+				log.Printf("Ignores Path: %s (Reason: %s)", filepath.Join(parentDir, entry.Name()), reason)
+				continue
 			}
 		}
+		if isImageFile(filepath.Join(parentDir, entry.Name())) {
+			item := sortItem{name: entry.Name()}
+			if info, err := entry.Info(); err == nil {
+				item.size, item.modTime = info.Size(), info.ModTime()
+			}
+			imageFileEntries = append(imageFileEntries, item)
+		}
+	}
 
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.WriteHeader(http.StatusNotFound)
-		err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
+	mode := imageModeNormal
+	if _, err := os.Stat(filepath.Join(parentDir, "__option_R2L__")); err == nil {
+		mode = imageModeR2L
+	} else if _, err := os.Stat(filepath.Join(parentDir, "__option_360VR__")); err == nil {
+		mode = imageMode360VR
+	}
+
+	// フォルダーリストと同じ並び順にする
+	sortOpts := getSortOptions(r, config)
+	sort.SliceStable(imageFileEntries, func(i, j int) bool {
+		return sortOpts.less(imageFileEntries[i], imageFileEntries[j])
+	})
+
+	var imagePaths []string
+	currentIndex := -1
+	for idx, entry := range imageFileEntries {
+		imagePaths = append(imagePaths, url.PathEscape(entry.name))
+		if entry.name == filepath.Base(fullPath) {
+			currentIndex = idx
+		}
 	}
+
+	// WS_BaseURLはURLエンコードされたフォルダパスを返す
+	parentURL := filepath.Dir(r.URL.Path) + "/"
+
+	return ImageData{
+		WS_Title:			template.URL(filepath.Base(fullPath)),
+		WS_Link:			template.URL(r.URL.Path),
+		WS_Mode:			mode,
+		WS_CurrentIndex:	currentIndex,
+		WS_ImagePaths:		imagePaths,
+		WS_ImageFile:		filepath.Base(fullPath),
+		WS_BaseURL:			template.URL(parentURL),
+	}, nil
 }
 
+// imageMaxSizeは設定ファイルから縮小の閾値を返します。未設定のときはデフォルト値を返します。
+func imageMaxSize(config *ServerConfig) int {
+	if config.Config.Image.MaxSize > 0 {
+		return config.Config.Image.MaxSize
+	}
+	return defaultImageMaxSize
+}
 
+// imageQualityは設定ファイルからJPEGの品質を返します。未設定のときはデフォルト値を返します。
+func imageQuality(config *ServerConfig) int {
+	if q := config.Config.Image.Quality; q > 0 && q <= 100 {
+		return q
+	}
+	return defaultImageQuality
+}
 
+// imageDimensionsは画像ファイルのヘッダーだけを読み込み、幅と高さを返します。
+// 画像全体はデコードしないので、大きな画像でも高速に処理できます。
+func imageDimensions(filePath string) (int, int, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("ファイルのオープンに失敗しました: %w", err)
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, fmt.Errorf("画像ヘッダーの読み込みに失敗しました: %w", err)
+	}
+	// 縦向きに撮った写真などは、表示するときの幅と高さにする
+	if swapsDimensions(imageOrientation(filePath)) {
+		return cfg.Height, cfg.Width, nil
+	}
+	return cfg.Width, cfg.Height, nil
+}
 
-// resizeAndSaveWithUUID は、指定された画像をリサイズし、
-// UUIDをファイル名として指定のフォルダに保存します。
-// 成功した場合は新しいファイルのフルパスを返します。
-func imageResize(inputPath string, size int, config *ServerConfig) (string, error) {
-
-	// 作業用フォルダー
-	outputDir := config.Config.Temporary
-
-	// UUIDを生成し、新しいファイル名を決定
-	newUUID := uuid.New().String()
-	
-	// 入力ファイルの拡張子を取得
-	ext := filepath.Ext(inputPath)
-	if ext == "" {
-		// 拡張子がない場合は、jpegとして扱うなどの代替処理が必要になる場合がある
-		// ここでは、デフォルトで.pngを使用する
-		ext = ".png" 
-	}
-	
-	newFileName := newUUID + ext
-	
-	// 保存先ファイルのフルパスを作成
-	// filepath.JoinでOSに依存しない適切なパスを構築
-	outputPath := filepath.Join(outputDir, newFileName)
-	
-	// sipsコマンドを組み立てる
-	// -Z (または --maxSize) は、縦横の長い辺が指定サイズになるように画像をリサイズします
-	// --out は出力先を指定します
-	sizeStr := strconv.Itoa(size)
-	
-	cmd := exec.Command("sips", "-Z", sizeStr, inputPath, "--out", outputPath)
-
-	// sipsコマンド実行 (標準出力/エラーは無視)
-	err := cmd.Run()
+// imageResizeは、指定された画像を縦横の長い辺がsizeになるように縮小し、キャッシュに保存します。
+// キャッシュ済みのときは縮小処理をせずにそのファイルを返します。
+// 成功した場合はキャッシュファイルのフルパスとキー、送信し終わったときに呼ぶ関数を返します。
+func imageResize(ctx context.Context, inputPath string, info os.FileInfo, size int, config *ServerConfig) (string, string, func(), error) {
+	quality := imageQuality(config)
+	key := cacheKey(inputPath, info, fmt.Sprintf("resize:%d:%d", size, quality))
+
+	cachedPath, release, err := getImageCache(config).getOrCreate(ctx, key+resizedImageExt(inputPath), func(ctx context.Context, w io.Writer) error {
+		log.Printf("Image: 縮小イメージの作成: '%s' (%d)", inputPath, size)
+		return resizeImageTo(w, inputPath, size, quality)
+	})
 	if err != nil {
-		// sipsコマンドが失敗した場合（例: 入力ファイルが存在しない、出力ディレクトリが存在しないなど）
-		return "", fmt.Errorf("sipsコマンド実行失敗: %w", err)
+		return "", "", nil, err
 	}
+	return cachedPath, key, release, nil
+}
 
-	// 4. 成功した場合、新しいファイルパスを返す
-	return outputPath, nil
+// resizedImageExtは縮小後の画像の拡張子を返します。
+// 透過を持つ可能性があるPNGとGIFはPNGで、それ以外はJPEGで書き出します。
+func resizedImageExt(inputPath string) string {
+	switch strings.ToLower(filepath.Ext(inputPath)) {
+	case ".png", ".gif":
+		return ".png"
+	}
+	return ".jpg"
 }
 
-// getImageProperties はsipsコマンドを実行し、画像情報をマップで返します。
-// 失敗した場合はnilとエラーを返します。
-func imageProperties(filePath string) (map[string]string, error) {
-	// sips -g all [ファイルパス] コマンドを構築
-	cmd := exec.Command("sips", "-g", "all", filePath)
-	
-	// コマンドを実行し、標準出力を取得
-	output, err := cmd.Output()
+// resizeImageToは画像をデコードして縮小し、wに書き出します。
+// 画素数がimageMaxPixelsを超える画像はデコードせずにエラーを返します。EXIFの向きは縮小した後に直します。
+func resizeImageTo(w io.Writer, inputPath string, size int, quality int) error {
+	f, err := os.Open(inputPath)
 	if err != nil {
-		return nil, fmt.Errorf("sipsコマンドの実行に失敗しました: %w", err)
+		return fmt.Errorf("ファイルのオープンに失敗しました: %w", err)
 	}
+	defer f.Close()
 
-	// 正規表現をコンパイル
-	// キーと値のペアを抽出するパターン
-	re := regexp.MustCompile(`\s*(\S+):\s*(.*)`)
+	// ヘッダーに書かれた大きさだけで、デコードしてよいかを決める
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return fmt.Errorf("画像ヘッダーの読み込みに失敗しました: %w", err)
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > imageMaxPixels {
+		return fmt.Errorf("画像が大きすぎます: %dx%d", cfg.Width, cfg.Height)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("ファイルのシークに失敗しました: %w", err)
+	}
 
-	// 抽出した結果を格納するマップを初期化
-	sipsProps := make(map[string]string)
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("画像のデコードに失敗しました: %w", err)
+	}
 
-	// 正規表現に一致するすべての部分文字列を検索
-	matches := re.FindAllStringSubmatch(string(output), -1)
+	dst := orientImage(scaleImage(src, size), imageOrientation(inputPath))
 
-	for _, match := range matches {
-		if len(match) >= 3 {
-			key := match[1]
-			value := match[2]
-			sipsProps[key] = value
+	if resizedImageExt(inputPath) == ".png" {
+		if err := png.Encode(w, dst); err != nil {
+			return fmt.Errorf("PNGのエンコードに失敗しました: %w", err)
 		}
+		return nil
 	}
-
-	return sipsProps, nil
+	if err := jpeg.Encode(w, dst, &jpeg.Options{Quality: quality}); err != nil {
+		return fmt.Errorf("JPEGのエンコードに失敗しました: %w", err)
+	}
+	return nil
 }
 
+// scaleImageは縦横比を保ったまま、長い辺がsizeになるように縮小した画像を返します。
+// 元の画像がsize以下のときは縮小しません。
+func scaleImage(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if size <= 0 || (width <= size && height <= size) {
+		return src
+	}
 
+	newWidth, newHeight := size, size
+	if width >= height {
+		newHeight = max(1, height*size/width)
+	} else {
+		newWidth = max(1, width*size/height)
+	}
 
+	dst := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, xdraw.Src, nil)
+	return dst
+}
@@ -0,0 +1,272 @@
+// Functions/imagemeta.go:画像のメタデータ:Functions/imagemeta.go
+//
+// 縮小する前に、画像全体をデコードせずにわかる情報を読み込む
+// JPEGのEXIFの向き（Orientation）と、GIFがアニメーションかどうかを調べる
+// どちらも公開フォルダーの中のファイルをそのまま読むので、壊れたファイルでも範囲外を読まずにエラーを返す
+//
+
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"os"
+)
+
+// 画像のメタデータに関する値
+const (
+	orientationNormal	= 1			// EXIFの向き: 回転なし
+	exifMaxSegment		= 64 * 1024	// JPEGのセグメントの最大の大きさ
+	exifOrientationTag	= 0x0112
+)
+
+var errNoOrientation = errors.New("EXIFの向きがありません")
+
+// imageOrientationはJPEGのEXIFから向き（1〜8）を返します。JPEG以外や、向きが無いときはorientationNormalを返します。
+func imageOrientation(filePath string) int {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return orientationNormal
+	}
+	defer f.Close()
+	orientation, err := readJPEGOrientation(f)
+	if err != nil {
+		return orientationNormal
+	}
+	return orientation
+}
+
+// readJPEGOrientationはJPEGのセグメントを順に読み、APP1のEXIFから向きを返します。
+// 画像データ（SOS）まで来ても見つからないときはerrNoOrientationを返します。
+func readJPEGOrientation(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return 0, fmt.Errorf("JPEGではありません")
+	}
+	for {
+		var marker [2]byte
+		if _, err := io.ReadFull(br, marker[:]); err != nil {
+			return 0, err
+		}
+		if marker[0] != 0xFF {
+			return 0, fmt.Errorf("JPEGのマーカーが壊れています")
+		}
+		switch {
+		case marker[1] == 0xFF:
+			// 埋め草のFF
+			br.UnreadByte()
+			continue
+		case marker[1] == 0xD8 || (marker[1] >= 0xD0 && marker[1] <= 0xD7) || marker[1] == 0x01:
+			// 長さの無いマーカー
+			continue
+		case marker[1] == 0xDA || marker[1] == 0xD9:
+			return 0, errNoOrientation
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(br, length[:]); err != nil {
+			return 0, err
+		}
+		size := int(binary.BigEndian.Uint16(length[:])) - 2
+		if size < 0 {
+			return 0, fmt.Errorf("JPEGのセグメントの長さが壊れています")
+		}
+		if marker[1] != 0xE1 || size > exifMaxSegment {
+			if _, err := br.Discard(size); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		segment := make([]byte, size)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return 0, err
+		}
+		if tiff, ok := bytes.CutPrefix(segment, []byte("Exif\x00\x00")); ok {
+			return exifOrientation(tiff)
+		}
+	}
+}
+
+// exifOrientationはTIFF形式のEXIFの最初のIFDから向きを返します。
+func exifOrientation(tiff []byte) (int, error) {
+	if len(tiff) < 8 {
+		return 0, fmt.Errorf("EXIFが短すぎます")
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, fmt.Errorf("EXIFのバイト順が不明です")
+	}
+	if order.Uint16(tiff[2:4]) != 42 {
+		return 0, fmt.Errorf("EXIFのTIFFヘッダーが壊れています")
+	}
+	offset := int64(order.Uint32(tiff[4:8]))
+	if offset+2 > int64(len(tiff)) {
+		return 0, fmt.Errorf("EXIFのIFDの位置が範囲外です")
+	}
+	count := int64(order.Uint16(tiff[offset:]))
+	entries := offset + 2
+	for i := int64(0); i < count; i++ {
+		entry := entries + i*12
+		if entry+12 > int64(len(tiff)) {
+			return 0, fmt.Errorf("EXIFのIFDが途中で切れています")
+		}
+		if order.Uint16(tiff[entry:]) != exifOrientationTag {
+			continue
+		}
+		// SHORT型の値は、値の欄の先頭2バイトに入っている
+		orientation := int(order.Uint16(tiff[entry+8:]))
+		if orientation < 1 || orientation > 8 {
+			return 0, fmt.Errorf("EXIFの向きが不明です: %d", orientation)
+		}
+		return orientation, nil
+	}
+	return 0, errNoOrientation
+}
+
+// swapsDimensionsは、向きを直すと幅と高さが入れ替わるかどうかを返します。
+func swapsDimensions(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+// orientImageはEXIFの向きに従って、画像を回転・反転します。
+func orientImage(src image.Image, orientation int) image.Image {
+	if orientation <= orientationNormal || orientation > 8 {
+		return src
+	}
+	rgba, ok := src.(*image.RGBA)
+	if !ok {
+		rgba = image.NewRGBA(image.Rect(0, 0, src.Bounds().Dx(), src.Bounds().Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, src.Bounds().Min, draw.Src)
+	}
+	w, h := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+	dw, dh := w, h
+	if swapsDimensions(orientation) {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			// 表示する位置(x, y)に来る元の画像の位置
+			var sx, sy int
+			switch orientation {
+			case 2:	// 左右反転
+				sx, sy = w-1-x, y
+			case 3:	// 180度回転
+				sx, sy = w-1-x, h-1-y
+			case 4:	// 上下反転
+				sx, sy = x, h-1-y
+			case 5:	// 左上と右下を結ぶ線で反転
+				sx, sy = y, x
+			case 6:	// 時計回りに90度回転
+				sx, sy = y, h-1-x
+			case 7:	// 右上と左下を結ぶ線で反転
+				sx, sy = w-1-y, h-1-x
+			case 8:	// 反時計回りに90度回転
+				sx, sy = w-1-y, x
+			}
+			si := rgba.PixOffset(sx+rgba.Rect.Min.X, sy+rgba.Rect.Min.Y)
+			di := dst.PixOffset(x, y)
+			copy(dst.Pix[di:di+4], rgba.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+// isAnimatedGIFはGIFファイルに2枚以上の画像が入っているかどうかを返します。
+// 画像データはデコードせず、ブロックを読み飛ばして数えます。
+func isAnimatedGIF(filePath string) bool {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	frames, err := countGIFFrames(f, 2)
+	return err == nil && frames >= 2
+}
+
+// countGIFFramesはGIFの画像の数を、limitまで数えて返します。
+func countGIFFrames(r io.Reader, limit int) (int, error) {
+	br := bufio.NewReader(r)
+	var header [13]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return 0, err
+	}
+	if string(header[:6]) != "GIF87a" && string(header[:6]) != "GIF89a" {
+		return 0, fmt.Errorf("GIFではありません")
+	}
+	if header[10]&0x80 != 0 {
+		// 全体のカラーテーブル
+		if _, err := br.Discard(3 << (header[10]&0x07 + 1)); err != nil {
+			return 0, err
+		}
+	}
+
+	frames := 0
+	for frames < limit {
+		block, err := br.ReadByte()
+		if err != nil {
+			return frames, err
+		}
+		switch block {
+		case 0x21:	// 拡張ブロック
+			if _, err := br.ReadByte(); err != nil {
+				return frames, err
+			}
+			if err := skipGIFSubBlocks(br); err != nil {
+				return frames, err
+			}
+		case 0x2C:	// 画像
+			var desc [9]byte
+			if _, err := io.ReadFull(br, desc[:]); err != nil {
+				return frames, err
+			}
+			if desc[8]&0x80 != 0 {
+				// その画像のカラーテーブル
+				if _, err := br.Discard(3 << (desc[8]&0x07 + 1)); err != nil {
+					return frames, err
+				}
+			}
+			// LZWの最小コードサイズ
+			if _, err := br.ReadByte(); err != nil {
+				return frames, err
+			}
+			if err := skipGIFSubBlocks(br); err != nil {
+				return frames, err
+			}
+			frames++
+		case 0x3B:	// 終わり
+			return frames, nil
+		default:
+			return frames, fmt.Errorf("GIFのブロックが壊れています: %#x", block)
+		}
+	}
+	return frames, nil
+}
+
+// skipGIFSubBlocksは長さ0のブロックまで、GIFのサブブロックを読み飛ばします。
+func skipGIFSubBlocks(br *bufio.Reader) error {
+	for {
+		size, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		if _, err := br.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+}
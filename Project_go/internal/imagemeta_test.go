@@ -0,0 +1,232 @@
+// Functions/imagemeta_test.go:画像のメタデータのテスト:Functions/imagemeta_test.go
+//
+// EXIFの向き・アニメーションGIFの判定・向きの補正・大きすぎる画像の拒否を調べる
+// 途中で切れたファイルや壊れたファイルでも、パニックせずにエラーになることを確かめる
+//
+
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// exifJPEGは向きのEXIFを付けた小さなJPEGを返します。
+func exifJPEG(t *testing.T, order binary.ByteOrder, orientation uint16) []byte {
+	t.Helper()
+	var img bytes.Buffer
+	if err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 4, 2)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// TIFFヘッダーと、向きだけのIFD
+	tiff := make([]byte, 8+2+12+4)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], exifOrientationTag)
+	order.PutUint16(tiff[12:], 3)	// SHORT
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], orientation)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+
+	out := append([]byte{}, img.Bytes()[:2]...)
+	out = append(out, app1...)
+	return append(out, img.Bytes()[2:]...)
+}
+
+func TestReadJPEGOrientation(t *testing.T) {
+	var plain bytes.Buffer
+	jpeg.Encode(&plain, image.NewGray(image.Rect(0, 0, 4, 2)), nil)
+	rotated := exifJPEG(t, binary.BigEndian, 6)
+	// APP1の直後（TIFFのIFDの途中）で切る
+	app1End := 2 + 4 + 6 + 14
+
+	tests := []struct {
+		name		string
+		data		[]byte
+		want		int
+		wantErr		bool
+	}{
+		{"II", exifJPEG(t, binary.LittleEndian, 3), 3, false},
+		{"MM", rotated, 6, false},
+		{"EXIF無し", plain.Bytes(), 0, true},
+		{"空", nil, 0, true},
+		{"JPEGではない", []byte("GIF89a"), 0, true},
+		{"マーカーの途中で切れる", rotated[:3], 0, true},
+		{"セグメントの途中で切れる", rotated[:app1End], 0, true},
+		{"向きが範囲外", exifJPEG(t, binary.BigEndian, 9), 0, true},
+		{"長さが壊れている", append([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x01}, rotated[6:]...), 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readJPEGOrientation(bytes.NewReader(tt.data))
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("readJPEGOrientation = %d, %v, want %d (error %v)", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExifOrientationBadOffsets(t *testing.T) {
+	tests := []struct {
+		name	string
+		tiff	[]byte
+	}{
+		{"短い", []byte("II*\x00")},
+		{"IFDが範囲外", []byte("II*\x00\xff\xff\xff\xff")},
+		{"IFDの数が多すぎる", []byte("II*\x00\x08\x00\x00\x00\xff\xff\x12\x01")},
+		{"バイト順が不明", []byte("XX*\x00\x08\x00\x00\x00\x00\x00")},
+		{"TIFFではない", []byte("II\x00\x00\x08\x00\x00\x00\x00\x00")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := exifOrientation(tt.tiff); err == nil {
+				t.Errorf("exifOrientation = %d, want error", got)
+			}
+		})
+	}
+}
+
+func TestOrientImage(t *testing.T) {
+	// 2x3の画像の各画素に、元の位置がわかる色を付ける
+	src := image.NewRGBA(image.Rect(0, 0, 2, 3))
+	for y := 0; y < 3; y++ {
+		for x := 0; x < 2; x++ {
+			src.Set(x, y, color.RGBA{uint8(x), uint8(y), 0, 255})
+		}
+	}
+	// 表示したときの左上・右上の画素の、元の位置
+	tests := []struct {
+		orientation	int
+		w, h		int
+		topLeft		[2]int
+		topRight	[2]int
+	}{
+		{1, 2, 3, [2]int{0, 0}, [2]int{1, 0}},
+		{2, 2, 3, [2]int{1, 0}, [2]int{0, 0}},
+		{3, 2, 3, [2]int{1, 2}, [2]int{0, 2}},
+		{4, 2, 3, [2]int{0, 2}, [2]int{1, 2}},
+		{5, 3, 2, [2]int{0, 0}, [2]int{0, 2}},
+		{6, 3, 2, [2]int{0, 2}, [2]int{0, 0}},
+		{7, 3, 2, [2]int{1, 2}, [2]int{1, 0}},
+		{8, 3, 2, [2]int{1, 0}, [2]int{1, 2}},
+	}
+	for _, tt := range tests {
+		dst := orientImage(src, tt.orientation)
+		if dst.Bounds().Dx() != tt.w || dst.Bounds().Dy() != tt.h {
+			t.Errorf("orientation %d: size = %v, want %dx%d", tt.orientation, dst.Bounds(), tt.w, tt.h)
+			continue
+		}
+		for _, c := range []struct {
+			x		int
+			want	[2]int
+		}{{0, tt.topLeft}, {tt.w - 1, tt.topRight}} {
+			r, g, _, _ := dst.At(c.x, 0).RGBA()
+			if got := [2]int{int(r >> 8), int(g >> 8)}; got != c.want {
+				t.Errorf("orientation %d: (%d, 0) = %v, want %v", tt.orientation, c.x, got, c.want)
+			}
+		}
+	}
+}
+
+func TestCountGIFFrames(t *testing.T) {
+	encode := func(frames int) []byte {
+		anim := &gif.GIF{}
+		for i := 0; i < frames; i++ {
+			anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White}))
+			anim.Delay = append(anim.Delay, 10)
+		}
+		var buf bytes.Buffer
+		if err := gif.EncodeAll(&buf, anim); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	animated := encode(3)
+
+	tests := []struct {
+		name	string
+		data	[]byte
+		want	int
+		wantErr	bool
+	}{
+		{"1枚", encode(1), 1, false},
+		{"アニメーション", animated, 2, false},
+		{"空", nil, 0, true},
+		{"GIFではない", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x00\x00"), 0, true},
+		{"途中で切れる", animated[:len(animated)/3], 0, true},
+		{"ブロックが壊れている", append(append([]byte{}, animated[:13+6]...), 0x99), 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := countGIFFrames(bytes.NewReader(tt.data), 2)
+			if (err != nil) != tt.wantErr || (!tt.wantErr && got != tt.want) {
+				t.Errorf("countGIFFrames = %d, %v, want %d (error %v)", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestResizeImageToRejectsHugeImages(t *testing.T) {
+	// IHDRだけの、とても大きな画像だと名乗るPNG
+	var png bytes.Buffer
+	png.WriteString("\x89PNG\r\n\x1a\n")
+	ihdr := make([]byte, 4+13)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], 50000)
+	binary.BigEndian.PutUint32(ihdr[8:], 50000)
+	ihdr[12], ihdr[13] = 8, 2	// 8ビットのRGB
+	binary.Write(&png, binary.BigEndian, uint32(13))
+	png.Write(ihdr)
+	binary.Write(&png, binary.BigEndian, crc32.ChecksumIEEE(ihdr))
+
+	filePath := filepath.Join(t.TempDir(), "huge.png")
+	if err := os.WriteFile(filePath, png.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := resizeImageTo(io.Discard, filePath, 100, 85)
+	if err == nil || !strings.Contains(err.Error(), "大きすぎます") {
+		t.Errorf("resizeImageTo = %v, want too large error", err)
+	}
+}
+
+func TestResizeImageToAppliesOrientation(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "rotated.jpg")
+	if err := os.WriteFile(filePath, exifJPEG(t, binary.LittleEndian, 6), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := resizeImageTo(&out, filePath, 100, 85); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := jpeg.DecodeConfig(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 2 || cfg.Height != 4 {
+		t.Errorf("size = %dx%d, want 2x4", cfg.Width, cfg.Height)
+	}
+	if w, h, err := imageDimensions(filePath); err != nil || w != 2 || h != 4 {
+		t.Errorf("imageDimensions = %d, %d, %v, want 2, 4", w, h, err)
+	}
+}
@@ -0,0 +1,95 @@
+// Functions/linkpolicy.go:シンボリックリンクの制限:Functions/linkpolicy.go
+//
+// 公開フォルダーの中のシンボリックリンクをたどってよいかを、設定ファイルのsymlinksで決める
+//	deny					シンボリックリンクをたどらない（公開フォルダー自体がリンクなのはかまわない）
+//	allow-within-roots		リンク先が公開フォルダーのどれかの中にあるときだけたどる（省略時）
+//	allow-all				どこへでもたどる
+// パスはfilepath.EvalSymlinksでリンクを全てたどってから調べるので、途中のフォルダーがリンクでも外には出られない
+// 許されていないパスは、どのハンドラーでも存在しないものとして404にする
+//
+
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// symlinksの値
+const (
+	linkPolicyDeny			= "deny"
+	linkPolicyWithinRoots	= "allow-within-roots"
+	linkPolicyAllowAll		= "allow-all"
+)
+
+// linkPolicyは設定ファイルからシンボリックリンクの扱いを返します。未設定や不明な値のときはallow-within-rootsです。
+func linkPolicy(config *ServerConfig) string {
+	switch policy := config.Config.Symlinks; policy {
+	case linkPolicyDeny, linkPolicyAllowAll:
+		return policy
+	}
+	return linkPolicyWithinRoots
+}
+
+// linkAllowedは、公開フォルダーrootの中のfullPathを開いてよいかを、シンボリックリンクの設定に従って返します。
+// アーカイブの中のパスや存在しないパスは、存在する部分までたどって調べます。
+func linkAllowed(root string, fullPath string, resolvedFolders map[string]string, config *ServerConfig) bool {
+	policy := linkPolicy(config)
+	if policy == linkPolicyAllowAll {
+		return true
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false
+	}
+	realPath := evalExistingSymlinks(fullPath)
+
+	if policy == linkPolicyDeny {
+		// リンクが無ければ、たどった後も公開フォルダーからの位置は変わらない
+		rel, err := filepath.Rel(root, fullPath)
+		if err != nil || !isWithinDir(root, fullPath) || realPath != filepath.Join(realRoot, rel) {
+			return false
+		}
+		// リンク先の無いリンク
+		if info, err := os.Lstat(fullPath); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return false
+		}
+		return true
+	}
+
+	return realPathInRoots(realPath, resolvedFolders)
+}
+
+// realPathInRootsは、リンクをたどった後のパスが公開フォルダーのどれかの中にあるかを返します。
+func realPathInRoots(realPath string, resolvedFolders map[string]string) bool {
+	for _, root := range resolvedFolders {
+		if realRoot, err := filepath.EvalSymlinks(root); err == nil && isWithinDir(realRoot, realPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// evalExistingSymlinksはパスのうち存在する部分のシンボリックリンクをたどり、残りを付け足したパスを返します。
+func evalExistingSymlinks(fullPath string) string {
+	p := filepath.Clean(fullPath)
+	rest := ""
+	for {
+		if realPath, err := filepath.EvalSymlinks(p); err == nil {
+			return filepath.Join(realPath, rest)
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return filepath.Clean(fullPath)
+		}
+		rest = filepath.Join(filepath.Base(p), rest)
+		p = parent
+	}
+}
+
+// isWithinDirは、pathがdirそのものか、dirの中にあるかを返します。
+func isWithinDir(dir string, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,86 @@
+// Functions/locale.go:表示用の書式:Functions/locale.go
+//
+// ブラウザーのAccept-Languageに合わせて、日付とファイルサイズの書式を変える
+//
+
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// localeFormatは言語ごとの日付の書式です。
+type localeFormat struct {
+	tag		language.Tag
+	date	string	// time.Formatの書式
+}
+
+// 対応している言語（先頭がデフォルト）
+var localeFormats = []localeFormat{
+	{language.Japanese, "2006/01/02 15:04"},
+	{language.AmericanEnglish, "Jan 2, 2006 3:04 PM"},
+	{language.BritishEnglish, "2 Jan 2006 15:04"},
+	{language.German, "02.01.2006 15:04"},
+	{language.French, "02/01/2006 15:04"},
+	{language.SimplifiedChinese, "2006/01/02 15:04"},
+	{language.Korean, "2006. 01. 02. 15:04"},
+}
+
+var localeMatcher = func() language.Matcher {
+	tags := make([]language.Tag, len(localeFormats))
+	for i, f := range localeFormats {
+		tags[i] = f.tag
+	}
+	return language.NewMatcher(tags)
+}()
+
+// localeFormatterはリクエストの言語に合わせて値を文字列にします。
+type localeFormatter struct {
+	format	localeFormat
+	printer	*message.Printer
+}
+
+// newLocaleFormatterはAccept-Languageから、最も近い言語の書式を選びます。
+func newLocaleFormatter(r *http.Request) localeFormatter {
+	tags, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	_, index, _ := localeMatcher.Match(tags...)
+	format := localeFormats[index]
+	return localeFormatter{
+		format:		format,
+		printer:	message.NewPrinter(format.tag),
+	}
+}
+
+// dateは日時を言語に合わせた書式で返します。
+func (f localeFormatter) date(t time.Time) string {
+	return t.Format(f.format.date)
+}
+
+// sizeはバイト単位のサイズを、言語に合わせた小数点と桁区切りで返します。
+func (f localeFormatter) size(size int64) string {
+	if size < 1024 {
+		return f.printer.Sprintf("%d B", size)
+	}
+	if size < 1024*1024 {
+		return f.printer.Sprintf("%.2f KB", float64(size)/1024)
+	}
+	if size < 1024*1024*1024 {
+		return f.printer.Sprintf("%.2f MB", float64(size)/1024/1024)
+	}
+	return f.printer.Sprintf("%.2f GB", float64(size)/1024/1024/1024)
+}
+
+// formatDurationは秒数を"1:02:03"や"2:03"の形式にします。
+func formatDuration(seconds float64) string {
+	total := int(seconds + 0.5)
+	h, m, s := total/3600, total/60%60, total%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
@@ -11,7 +11,6 @@ import (
 	"io"
 	"path/filepath"
 
-	"strings"
 //	"io/ioutil" //MarkdownテキストをHTMLテキスト化用
 	"github.com/gomarkdown/markdown"	//MarkdownテキストをHTMLテキストに変換するライブラリ
 	
@@ -22,64 +21,32 @@ import (
 
 // HandleMarkdownRequestは画像ビューアのHTMLを返します。
 func HandleMarkdownRequest(resolvedFolders map[string]string, config *ServerConfig, markdownTmpl *template.Template, err404Tmpl *template.Template) http.HandlerFunc {
+	paths := newPathResolver(resolvedFolders, config)
 	return func(w http.ResponseWriter, r *http.Request) {
 		requestedPath := getRequestedPath(r)
 
 		// 許可されたルートフォルダを基に、完全なファイルパスを再構築
-		var fullPath string
-		pathParts := strings.Split(requestedPath, string(os.PathSeparator))
-		firstFolder := pathParts[0]
-
-		if resolvedPath, ok := resolvedFolders[firstFolder]; ok {
-			fullPath = resolvedPath
-			if len(pathParts) > 1 {
-				subPath := filepath.Join(pathParts[1:]...)
-				fullPath = filepath.Join(resolvedPath, subPath)
+		if fullPath, _, ok := paths.resolveFile(requestedPath); ok {
+			// MDファイルが存在する場合、テンプレートを返す
+			markdownData, err := buildMarkdownData(r, fullPath)
+			if err != nil {
+				// ファイルが見つからない、または読み込めない場合
+				log.Printf("Markdown: ファイルの読み込みに失敗しました: '%s' %v", fullPath, err)
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.WriteHeader(http.StatusInternalServerError)
+				err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
+				return
 			}
 
-			_, err := os.Stat(fullPath)
-			if err == nil {
-				// MDファイルが存在する場合、テンプレートを返す
-
-				// 1. ファイルの読み込み
-//				mdBytes, err := ioutil.ReadFile(fullPath)
-				mdBytes, err := readWithBOMOverride(fullPath)
-				if err != nil {
-					// ファイルが見つからない、または読み込めない場合
-					log.Printf("Markdown: ファイルの読み込みに失敗しました: '%s' %v", fullPath, err)
-					w.Header().Set("Content-Type", "text/html; charset=utf-8")
-					w.WriteHeader(http.StatusInternalServerError)
-					err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
-					return
-				}
-
-				// 2. MarkdownをHTMLに変換
-				log.Printf("Markdown: MDのHTML化: '%s'", fullPath)
-				htmlContent := MarkdownToHTML(string(mdBytes))		
-
-				// 2. 変換後のHTML文字列を template.HTML 型にキャスト
-				safeHTML := template.HTML(htmlContent) 
-				
-				// WS_BaseURLはURLエンコードされたフォルダパスを返す
-				parentURL := filepath.Dir(r.URL.Path) + "/"
-
-				markdownData := MarkdownData{
-					WS_Title:			template.URL(filepath.Base(fullPath)),
-					WS_Link:			template.URL(r.URL.Path),
-					WS_BaseURL:			template.URL(parentURL),
-					WS_Content:			safeHTML,
-				}
-
-				// 3. レスポンスとしてクライアントに送り返す			
+			// 3. レスポンスとしてクライアントに送り返す			
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if err := markdownTmpl.Execute(w, markdownData); err != nil {
+				log.Printf("Markdown: テンプレートの実行に失敗しました: %v", err)
 				w.Header().Set("Content-Type", "text/html; charset=utf-8")
-				if err := markdownTmpl.Execute(w, markdownData); err != nil {
-					log.Printf("Markdown: テンプレートの実行に失敗しました: %v", err)
-					w.Header().Set("Content-Type", "text/html; charset=utf-8")
-					w.WriteHeader(http.StatusInternalServerError)
-					err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
-				}
-				return
+				w.WriteHeader(http.StatusInternalServerError)
+				err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
 			}
+			return
 		}
 
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -89,6 +56,29 @@ func HandleMarkdownRequest(resolvedFolders map[string]string, config *ServerConf
 }
 
 
+// buildMarkdownDataはMDファイルを読み込んでHTML化し、テンプレートに渡すデータを組み立てます。
+func buildMarkdownData(r *http.Request, fullPath string) (MarkdownData, error) {
+	// 1. ファイルの読み込み
+	mdBytes, err := readWithBOMOverride(fullPath)
+	if err != nil {
+		return MarkdownData{}, err
+	}
+
+	// 2. MarkdownをHTMLに変換
+	log.Printf("Markdown: MDのHTML化: '%s'", fullPath)
+	htmlContent := MarkdownToHTML(string(mdBytes))
+
+	// WS_BaseURLはURLエンコードされたフォルダパスを返す
+	parentURL := filepath.Dir(r.URL.Path) + "/"
+
+	return MarkdownData{
+		WS_Title:			template.URL(filepath.Base(fullPath)),
+		WS_Link:			template.URL(r.URL.Path),
+		WS_BaseURL:			template.URL(parentURL),
+		WS_Content:			template.HTML(htmlContent), // 変換後のHTML文字列を template.HTML 型にキャスト
+	}, nil
+}
+
 // MarkdownToHTML は、MarkdownテキストをHTMLテキストに変換します。
 func MarkdownToHTML(mdText string) string {
 	// シンプルな変換を実行
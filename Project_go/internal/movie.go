@@ -10,22 +10,59 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 
 
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"strconv"
 )
 
-func HandleMovieFFmpeg(w http.ResponseWriter, r *http.Request, filePath string, config *ServerConfig) {
+// HandleMovieFFmpegはffmpegで動画をMP4に変換しながら送信します。
+// startが0より大きいときは、その位置（秒）から変換します。
+// ブラウザーが接続を切ったときは、ffmpegも終了させます。
+func HandleMovieFFmpeg(w http.ResponseWriter, r *http.Request, filePath string, start float64, config *ServerConfig) {
 
-	// ffmpeg コマンド
-	cmd := exec.Command("ffmpeg",
-		"-i", filePath,
-		"-c:v", "libx264",
+	// ブラウザーで再生できるストリームはコピーし、それ以外だけを変換する
+	info, _ := os.Stat(filePath)
+	profileName, profile := transcodeProfile(r, config)
+	plan := planTranscode(r.Context(), filePath, info, profileName, profile, config)
+	log.Printf("Movie: 変換方法: '%s' (%s)", filePath, plan)
+
+	// -ssを-iの前に置くと、キーフレーム単位ですばやくシークできる
+	var args []string
+	if start > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(start, 'f', 3, 64))
+	}
+	args = append(args, "-i", filePath)
+	args = append(args, plan.codecArgs()...)
+	args = append(args,
 		"-f", "mp4",
 		"-movflags", "frag_keyframe+empty_moov+default_base_moof",
 		"pipe:1")
+	streamFFmpeg(w, r, filePath, "stream", args, "video/mp4", config)
+}
+
+// streamFFmpegはffmpegを実行し、標準出力をそのままレスポンスとして送信します。
+// 同時に変換できる数を超えているときは空くまで待ち、ブラウザーが接続を切ったときはffmpegも終了させます。
+func streamFFmpeg(w http.ResponseWriter, r *http.Request, filePath string, kind string, args []string, contentType string, config *ServerConfig) {
+
+	// 同時に変換できる数を超えているときは、空くまで待つ
+	release, err := getTranscodeLimiter(config).acquire(r.Context(), kind, filePath)
+	if err != nil {
+		if errors.Is(err, errTranscodeBusy) {
+			w.Header().Set("Retry-After", "10")
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		}
+		return
+	}
+	defer release()
+
+	// ffmpeg コマンド（リクエストのコンテキストに結びつけ、接続が切れたら終了させる）
+	cmd := exec.CommandContext(r.Context(), "ffmpeg", args...)
 
 	// 標準出力のパイプを取得
 	stdout, err := cmd.StdoutPipe()
@@ -36,7 +73,7 @@ func HandleMovieFFmpeg(w http.ResponseWriter, r *http.Request, filePath string,
 	}
 
 	// HTTPレスポンスヘッダーの設定
-	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Type", contentType)
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Transfer-Encoding", "chunked")
 
@@ -51,22 +88,154 @@ func HandleMovieFFmpeg(w http.ResponseWriter, r *http.Request, filePath string,
 	_, err = io.Copy(w, stdout)
 	if err != nil {
 		log.Println("Movie: io.Copy error:", err)
-		// エラーハンドリングは必要に応じて
+		// 送信できなくなったときは、ffmpegを止める
+		cmd.Process.Kill()
 	}
 
 	// プロセスの終了を待機し、リソースを解放
 	if err := cmd.Wait(); err != nil {
-		log.Println("Movie: ffmpeg Wait error:", err)
+		if r.Context().Err() != nil {
+			log.Printf("Movie: 接続が切れたため変換を中止しました: '%s'", filePath)
+		} else {
+			log.Println("Movie: ffmpeg Wait error:", err)
+		}
+		return
 	}
 
 	fmt.Println("Movie: Streaming complete.")
 }
 
+// parseStartOffsetは?t=秒から再生を始める位置を返します。
+// 指定が無いときや正しくないときは0、動画の長さが分かるときはそれを超えない値を返します。
+func parseStartOffset(r *http.Request, duration float64) float64 {
+	start, err := strconv.ParseFloat(r.URL.Query().Get("t"), 64)
+	if err != nil || math.IsNaN(start) || start < 0 {
+		return 0
+	}
+	if duration > 0 && start >= duration {
+		return 0
+	}
+	return start
+}
+
 
 
 
+// setMovieInfoはffprobeで取得した動画の情報を、テンプレートに渡すデータに設定します。
+func setMovieInfo(data *VideoTemplateData, probe *movieProbe) {
+	if duration := probe.duration(); duration > 0 {
+		data.WS_Duration = duration
+		data.WS_DurationText = formatDuration(duration)
+	}
+	if video, ok := probe.videoStream(); ok {
+		data.WS_VideoCodec = video.CodecName
+		if video.Width > 0 && video.Height > 0 {
+			data.WS_Resolution = fmt.Sprintf("%dx%d", video.Width, video.Height)
+		}
+	}
+	if bitRate, err := strconv.ParseFloat(probe.Format.BitRate, 64); err == nil && bitRate > 0 {
+		data.WS_BitRate = fmt.Sprintf("%.1f Mbps", bitRate/1000000)
+	}
+
+	for i, stream := range probe.audioStreams() {
+		_, label := subtitleLanguage(stream.Tags["language"])
+		if title := stream.Tags["title"]; title != "" {
+			if label != "" {
+				label += " - "
+			}
+			label += title
+		}
+		if label == "" {
+			label = fmt.Sprintf("音声 %d", i+1)
+		}
+		data.WS_AudioTracks = append(data.WS_AudioTracks, AudioTrack{
+			WS_Label:		label,
+			WS_Codec:		stream.CodecName,
+			WS_Channels:	stream.Channels,
+		})
+	}
+
+	// チャプター（タイトルが無いときは番号）
+	for i, chapter := range probe.Chapters {
+		start, err := strconv.ParseFloat(chapter.StartTime, 64)
+		if err != nil || start < 0 {
+			continue
+		}
+		title := chapter.Tags["title"]
+		if title == "" {
+			title = fmt.Sprintf("チャプター %d", i+1)
+		}
+		var percent float64
+		if data.WS_Duration > 0 {
+			percent = min(start/data.WS_Duration*100, 100)
+		}
+		data.WS_Chapters = append(data.WS_Chapters, VideoChapter{
+			WS_Title:		title,
+			WS_Start:		start,
+			WS_StartText:	formatDuration(start),
+			WS_Percent:		percent,
+		})
+	}
+}
+
+// setMovieSiblingsは同じフォルダーの動画の一覧と、前後の動画へのリンクを設定します。
+// 並び順はフォルダーリストと同じで、並び順の指定はリンクに引き継ぎます。
+func setMovieSiblings(data *VideoTemplateData, r *http.Request, fullPath string, config *ServerConfig) {
+	parentDir := filepath.Dir(fullPath)
+	dirEntries, err := os.ReadDir(parentDir)
+	if err != nil {
+		log.Printf("Movie: フォルダの読み込みに失敗しました: '%s' %v", parentDir, err)
+		return
+	}
+
+	var movieEntries []sortItem
+	for _, entry := range dirEntries {
+		if entry.IsDir() || !IsMovieFile(entry.Name()) {
+			continue
+		}
+		if ignored, _ := isIgnored(entry.Name(), config.Ignores); ignored {
+			continue
+		}
+		item := sortItem{name: entry.Name()}
+		if info, err := entry.Info(); err == nil {
+			item.size, item.modTime = info.Size(), info.ModTime()
+		}
+		movieEntries = append(movieEntries, item)
+	}
+
+	sortOpts := getSortOptions(r, config)
+	sort.SliceStable(movieEntries, func(i, j int) bool {
+		return sortOpts.less(movieEntries[i], movieEntries[j])
+	})
+
+	data.WS_CurrentIndex = -1
+	for idx, entry := range movieEntries {
+		data.WS_MoviePaths = append(data.WS_MoviePaths, url.PathEscape(entry.name))
+		if entry.name == filepath.Base(fullPath) {
+			data.WS_CurrentIndex = idx
+		}
+	}
+	if data.WS_CurrentIndex < 0 {
+		return
+	}
+
+	query := ""
+	if kept := listingQuery(r); len(kept) > 0 {
+		query = "?" + kept.Encode()
+	}
+	if i := data.WS_CurrentIndex - 1; i >= 0 {
+		data.WS_PrevLink = template.URL(data.WS_MoviePaths[i] + ".movie.html" + query)
+		data.WS_PrevTitle = movieEntries[i].name
+	}
+	if i := data.WS_CurrentIndex + 1; i < len(movieEntries) {
+		data.WS_NextLink = template.URL(data.WS_MoviePaths[i] + ".movie.html" + query)
+		data.WS_NextTitle = movieEntries[i].name
+	}
+}
+
 // HandleMoviePageは動画再生ページをレンダリングします。
 func HandleMoviePage(resolvedFolders map[string]string, config *ServerConfig, movieTmpl *template.Template, err404Tmpl *template.Template) http.HandlerFunc {
+	paths := newPathResolver(resolvedFolders, config)
 	return func(w http.ResponseWriter, r *http.Request) {
 		requestedPath := getRequestedPath(r)
 
@@ -74,23 +243,7 @@ func HandleMoviePage(resolvedFolders map[string]string, config *ServerConfig, mo
 
 		// 元の動画ファイルパスを取得するために.movie.htmlを削除
 		originalPath := strings.TrimSuffix(requestedPath, ".movie.html")
-
-		// URLエンコードされた元のファイル名を取得
-		originalFileName := filepath.Base(originalPath)
-
-		// リンク生成のために親フォルダのパスを取得
-		parentURL := filepath.Dir(r.URL.Path)
-		if parentURL == "." {
-			parentURL = ""
-		}
-		parentURL = "/" + url.PathEscape(parentURL) + "/"
-
-		// テンプレートに渡すデータを作成
-		imageData := VideoTemplateData{
-			WS_Title:   originalFileName,
-			WS_Link:    "/" + originalPath,
-			WS_BaseURL: template.URL(parentURL),
-		}
+		imageData := buildMovieData(w, r, originalPath, paths, config)
 
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		if err := movieTmpl.Execute(w, imageData); err != nil {
@@ -102,8 +255,67 @@ func HandleMoviePage(resolvedFolders map[string]string, config *ServerConfig, mo
 	}
 }
 
+// buildMovieDataは動画再生ページに渡すデータを組み立てます。リンクはr.URL.Path（.movie.htmlのURL）を基準にします。
+// 動画が見つからないときも、ページを表示できるだけのデータを返します。
+func buildMovieData(w http.ResponseWriter, r *http.Request, originalPath string, paths pathResolver, config *ServerConfig) VideoTemplateData {
+	// URLエンコードされた元のファイル名を取得
+	originalFileName := filepath.Base(originalPath)
+
+	// リンク生成のために親フォルダのパスを取得
+	parentURL := filepath.Dir(r.URL.Path)
+	if parentURL == "." {
+		parentURL = ""
+	}
+	parentURL = "/" + url.PathEscape(parentURL) + "/"
+
+	// テンプレートに渡すデータを作成
+	imageData := VideoTemplateData{
+		WS_Title:   originalFileName,
+		WS_Link:    "/" + originalPath,
+		WS_BaseURL: template.URL(parentURL),
+	}
+
+	// 動画の長さ（変換しながら送信するときは、シークバーを作るのに使う）
+	transcoded := needsTranscode(originalPath)
+	if fullPath, info, ok := paths.resolveFile(originalPath); ok {
+		// 映像の変換が必要な動画はHLSで再生する
+		if useHLS(r, fullPath, info, config) {
+			imageData.WS_HLSLink = "/hls/" + originalPath + "/master.m3u8"
+		}
+		// 変換済みのときは、HLSを使わずに保存してあるMP4を再生する
+		if _, release, ok := cachedTranscode(r.Context(), fullPath, info, config); ok {
+			release()
+			if transcoded && r.URL.Query().Get("mode") != "hls" {
+				imageData.WS_HLSLink = ""
+				transcoded = false
+			}
+		}
+		imageData.WS_Subtitles = findSubtitles(r, originalPath, fullPath, info, config)
+		if probe, err := probeMovie(r.Context(), fullPath, info, config); err == nil {
+			setMovieInfo(&imageData, probe)
+		} else {
+			log.Printf("Movie: 動画の情報を取得できません: '%s' %v", fullPath, err)
+		}
+		imageData.WS_Poster = fmt.Sprintf("/%s.thumb?size=%d", originalPath, maxThumbnailSize)
+		setMovieSiblings(&imageData, r, fullPath, config)
+	}
+	imageData.WS_Transcoded = imageData.WS_HLSLink == "" && transcoded
+	imageData.WS_Start = parseStartOffset(r, imageData.WS_Duration)
+
+	// ?t=が無いときは、前回の続きから再生する
+	imageData.WS_ProgressLink = template.URL(apiPrefix + "progress/" + escapeURLPath(originalPath))
+	viewer := ensureViewerID(w, r)
+	if entry, ok := getProgressStore(config).get(viewer, originalPath); ok && !r.URL.Query().Has("t") {
+		imageData.WS_Start = entry.Position
+		imageData.WS_Resumed = true
+		imageData.WS_StartText = formatDuration(entry.Position)
+	}
+	return imageData
+}
+
 // HandleMovieStreamingは動画ファイルをMP4に変換してストリーミングする
 func HandleMovieStreaming(resolvedFolders map[string]string, config *ServerConfig, err404Tmpl *template.Template) http.HandlerFunc {
+	paths := newPathResolver(resolvedFolders, config)
 	return func(w http.ResponseWriter, r *http.Request) {
 		
 		// リクエストパスの取り出し
@@ -111,32 +323,26 @@ func HandleMovieStreaming(resolvedFolders map[string]string, config *ServerConfi
 		
 //		log.Printf("Movie: リクエスト受取: '%s'", requestedPath)
 		
-		// リクエストされたファイルパスを得る
-		var fullPath string
-//		pathParts := strings.Split(requestedPath, string(os.PathSeparator))
-		pathParts := strings.Split(requestedPath, "/") // フォルダー階層お名称を配列化
-		firstFolder := pathParts[0] //最初の階層を取り出す
-		if resolvedPath, ok := resolvedFolders[firstFolder]; ok { //最初の階層がFoldersで設定されたフォルダー群にあるか調べる
-			fullPath = resolvedPath // リクエストされたフォルダーのパス
-			// 残りのフォルダー階層を繋げてリクエストされたファイルの絶対パスを得る
-			if len(pathParts) > 1 {
-				subPath := filepath.Join(pathParts[1:]...)
-				fullPath = filepath.Join(resolvedPath, subPath)
-			}
+		// リクエストされたファイルのパスと情報
+		target, ok := paths.resolve(requestedPath)
+		if !ok {
+			log.Printf("Movie: 404: '%s'", requestedPath)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusNotFound)
+			err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
+			return
 		}
-		
-		// リクエストされたファイルの情報
-		fileInfo, fileErr := os.Stat(fullPath)
+		fullPath, fileInfo := target.fullPath, target.info
 
 		// SWFは変換して送信			
 		if strings.HasSuffix(strings.ToLower(fullPath), ".swf") {
 			log.Printf("Movie: SWFファイルの送信: '%s'", fullPath)
-			HandleMovieFFmpeg(w, r, fullPath, config)
+			HandleMovieFFmpeg(w, r, fullPath, parseStartOffset(r, 0), config)
 			return
 		}
 
 		// ファイルが存在しないときは404を返す
-		if fileErr != nil || !fileInfo.Mode().IsRegular() || !IsMovieFile(fullPath) {
+		if !target.isFile() || !IsMovieFile(fullPath) {
 			log.Printf("Movie: 404: '%s'", fullPath)
 			w.Header().Set("Content-Type", "text/html; charset=utf-8")
 			w.WriteHeader(http.StatusNotFound)
@@ -144,6 +350,13 @@ func HandleMovieStreaming(resolvedFolders map[string]string, config *ServerConfi
 			return
 		}
 
+		// ?original=1のときは変換せずにそのまま送信（外部のプレイヤーで再生するプレイリスト用）
+		if r.URL.Query().Get("original") == "1" {
+			log.Printf("Movie: 元のファイルの送信: '%s'", fullPath)
+			http.ServeFile(w, r, fullPath)
+			return
+		}
+
 		// MP4はそのまま送信			
 		if strings.HasSuffix(strings.ToLower(fullPath), ".mp4") {
 			log.Printf("Movie: MP4ファイルの送信: '%s'", fullPath)
@@ -159,8 +372,31 @@ func HandleMovieStreaming(resolvedFolders map[string]string, config *ServerConfi
 		}
 
 		// その他のファイルはMP4に変換して送信
-		log.Printf("Movie: MP4に変換して送信: '%s'", requestedPath)
-		HandleMovieFFmpeg(w, r, fullPath, config)
+		// 変換済みのときは、保存してあるMP4を送信する（Rangeリクエストでシークできる）
+		// ?profile=で設定ファイルと違うプロファイルが指定されたときは、保存してあるMP4を使わない
+		start := parseStartOffset(r, 0)
+		profileName, _ := transcodeProfile(r, config)
+		defaultProfileName, _ := transcodeProfile(nil, config)
+		if profileName == defaultProfileName {
+			if cachedPath, release, ok := cachedTranscode(r.Context(), fullPath, fileInfo, config); ok {
+				if start == 0 {
+					log.Printf("Movie: 変換済みのMP4を送信: '%s'", requestedPath)
+					http.ServeFile(w, r, cachedPath)
+					release()
+					return
+				}
+				release()
+			}
+			// pretranscodeが有効なときは、次から保存してあるMP4を使えるようにバックグラウンドでも変換する
+			enqueueTranscode(r.Context(), fullPath, fileInfo, config)
+		}
+		if start > 0 {
+			if duration, err := movieDuration(r.Context(), fullPath, fileInfo, config); err == nil {
+				start = parseStartOffset(r, duration)
+			}
+		}
+		log.Printf("Movie: MP4に変換して送信: '%s' (%.1f秒から)", requestedPath, start)
+		HandleMovieFFmpeg(w, r, fullPath, start, config)
 			
 	}
 }
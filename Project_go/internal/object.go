@@ -10,12 +10,9 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
 	"regexp"
-	"strconv"
-	"bytes"		//エイリアス判定用
-	"os/exec"	//エイリアス判定用
+	"mime"
 )
 
 // ResolvedFoldersを初期化するためのヘルパー関数
@@ -41,6 +38,9 @@ func isIgnored(name string, ignores []string) (bool, string) {
 	if name == "__option_360VR__" {
 		return true, "オプションファイル"
 	}
+	if name == "__option_grid__" {
+		return true, "オプションファイル"
+	}
 	for _, pattern := range ignores {
 		if matched, err := regexp.MatchString(pattern, name); err == nil && matched {
 			return true, fmt.Sprintf("パターン '%s' に一致しました", pattern)
@@ -54,36 +54,15 @@ func isIgnored(name string, ignores []string) (bool, string) {
 
 // HandleObjectRequestはフォルダの内容を一覧表示します。
 func HandleObjectRequest(resolvedFolders map[string]string, config *ServerConfig, indexTmpl *template.Template, folderTmpl *template.Template, err404Tmpl *template.Template) http.HandlerFunc {
+	paths := newPathResolver(resolvedFolders, config)
 	return func(w http.ResponseWriter, r *http.Request) {
 		requestedPath := getRequestedPath(r)
 
 		// ルートパスの場合
 		if requestedPath == "" {
 			log.Printf("Object: ルートパスがリクエストされました")
-			var entries []WS_FileEntry
-			for name := range resolvedFolders {
-				entries = append(entries, WS_FileEntry{
-//					WS_Name:        name,
-//					WS_Link:        name,
-					WS_Name:        name,
-					WS_Link:		strings.ReplaceAll(url.PathEscape(name), "+", "%20") + "/",
-//					WS_IsDirectory: true,
-				})
-			}
-			// フォルダとファイルをそれぞれソート
-//			sort.Slice(entries, func(i, j int) bool {
-//				return entries[i].WS_Name < entries[j].WS_Name
-//			})
-			sort.Slice(entries, func(i, j int) bool {
-//				return entries[i].WS_Name < entries[j].WS_Name
-				return strings.ToLower(entries[i].WS_Name) < strings.ToLower(entries[j].WS_Name)
-			})
-			data := FolderData{
-				WS_Title:		"Web Server",
-				WS_Link:		"/",
-				WS_ParentPath:	"",
-				WS_Objects:		entries,
-			}
+			data := buildRootData(resolvedFolders)
+			data.WS_Continue = continueWatching(r, paths, config, progressListLimit)
 			w.Header().Set("Content-Type", "text/html; charset=utf-8")
 			if err := indexTmpl.Execute(w, data); err != nil {
 				log.Printf("Object: テンプレートの実行に失敗しました: %v", err)
@@ -95,79 +74,73 @@ func HandleObjectRequest(resolvedFolders map[string]string, config *ServerConfig
 		}
 
 		// ルート以外のパス
-		var fullPath string
-		pathParts := strings.Split(requestedPath, string(os.PathSeparator))
-		firstFolder := pathParts[0]
+		if target, ok := paths.resolve(requestedPath); ok {
+			fullPath := target.fullPath
+			info := target.info
 
-		if resolvedPath, ok := resolvedFolders[firstFolder]; ok {
-			fullPath = resolvedPath
-			if len(pathParts) > 1 {
-				subPath := filepath.Join(pathParts[1:]...)
-				fullPath = filepath.Join(resolvedPath, subPath)
+			// アーカイブの中のパス、または/付きでリクエストされたアーカイブは仮想フォルダーとして扱う
+			if target.kind == pathInArchive {
+				handleArchiveObject(w, r, target.archivePath, target.inner, config, folderTmpl, err404Tmpl)
+				return
 			}
-			
-			info, err := os.Stat(fullPath)
-			if err != nil || !info.IsDir() {
-				isImage := isImageFile(fullPath)
-				resolvedAlias, errAlias:= resolveAlias(fullPath) // エイリアスのときはオリジナルのパスが返る
+			if target.isFile() && isBrowsableArchive(fullPath) && strings.HasSuffix(r.URL.Path, "/") {
+				handleArchiveObject(w, r, fullPath, "", config, folderTmpl, err404Tmpl)
+				return
+			}
+
+			if target.kind != pathDir {
+				isImage := target.isFile() && isImageFile(fullPath)
 				if isImage {
-					props, err := imageProperties(fullPath)
+					width, height, err := imageDimensions(fullPath)
 					if err != nil {
 						log.Printf("Object: 画像のプロパティ取得に失敗しました: %v", err)
 						log.Printf("Object: イメージファイルを直接送信: '%s'", fullPath)
 						http.ServeFile(w, r, fullPath)
+						return
 					}
-					var width int
-					var height int
-					if value, ok := props["pixelWidth"]; ok {
-						width, _ = strconv.Atoi(value)
-					} else {
-						width = 0
-					}
-					if value, ok := props["pixelHeight"]; ok {
-						height, _ = strconv.Atoi(value)
-					} else {
-						height = 0
-					}
-					if width > 2000 || height > 2000 {
-						workFile, err := imageResize (fullPath, 2000, config)
+					// アニメーションGIFは縮小すると1枚の画像になってしまうので、そのまま送信する
+					maxSize := imageMaxSize(config)
+					if (width > maxSize || height > maxSize) && !isAnimatedGIF(fullPath) {
+						cachedFile, key, release, err := imageResize(r.Context(), fullPath, info, maxSize, config)
 						if err != nil {
 							log.Println("Object: イメージの縮小に失敗:", err)
 							log.Printf("Object: イメージファイルの送信: '%s'", fullPath)
 							http.ServeFile(w, r, fullPath)
-						} else {							
+						} else {
 							log.Printf("Object: 縮小イメージファイルの送信: '%s'", fullPath)
-							http.ServeFile(w, r, workFile)
-							err = os.Remove(workFile)
-							if err != nil {
-								log.Println("Object: ファイル削除エラー:", err)
-							} else {
-								log.Println("Object: ファイル削除:", workFile)
-							}
+							serveCachedFile(w, r, cachedFile, key, info.ModTime())
+							release()
 						}
 					} else {
 						log.Printf("Object: イメージファイルの送信: '%s'", fullPath)
 						http.ServeFile(w, r, fullPath)
 					}
-				} else if errAlias == nil {
-					// エイリアスファイルのときは、エイリアス先にリダイレクトする
-					log.Printf("Object: エイリアスファイル!! '%s'", resolvedAlias)
-					for _, prefix := range config.Folders {
-						if strings.HasPrefix(resolvedAlias, prefix) {
-							linkPath := resolvedAlias[len(prefix)+1:]+"/" // 一致した部分を削除して返す
-							parts := strings.Split(linkPath, "/")
-							for i := 2; i < len(parts); i++ {
-								if parts[i] != "" {
-									linkPath = "../" + linkPath // 有効なフォルダー階層の分だけ../に戻るようにする
-								}
-							}
-							log.Printf("Object: 編集されたパス '%s'", linkPath)
-							http.Redirect(w, r, linkPath, http.StatusSeeOther) // 301リダイレクトする
-							return 
+				} else if linkTarget, errAlias := resolveAlias(fullPath); errAlias == nil {
+					// エイリアスやショートカットのときは、リンク先にリダイレクトする
+					log.Printf("Object: エイリアスファイル!! '%s' -> '%s'", fullPath, linkTarget)
+					// インターネットのURLへは、symlinksがallow-allのときだけリダイレクトする。それ以外はショートカットのファイルをそのまま送信する
+					if isAliasURL(linkTarget) {
+						if linkPolicy(config) == linkPolicyAllowAll {
+							http.Redirect(w, r, linkTarget, http.StatusSeeOther)
+							return
 						}
+						log.Printf("Object: ファイルの送信: '%s'", fullPath)
+						http.ServeFile(w, r, fullPath)
+						return
+					}
+					if linkPath, ok := aliasRedirect(linkTarget, resolvedFolders, config); ok {
+						log.Printf("Object: 編集されたパス '%s'", linkPath)
+						http.Redirect(w, r, linkPath, http.StatusSeeOther)
+						return
+					}
+					// allow-allのときは、公開フォルダーの外へのシンボリックリンクもそのまま送信する
+					if link, lerr := os.Lstat(fullPath); lerr == nil && link.Mode()&os.ModeSymlink != 0 && info != nil && linkPolicy(config) == linkPolicyAllowAll {
+						log.Printf("Object: ファイルの送信: '%s'", fullPath)
+						http.ServeFile(w, r, fullPath)
+						return
 					}
 					// 公開されていないフォルダーへのエイリアスはダウンロードも許さない
-					log.Printf("Object: エイリアスファイルのためダウンロードできません: '%s' %v", fullPath, err)
+					log.Printf("Object: エイリアスファイルのためダウンロードできません: '%s'", fullPath)
 					w.Header().Set("Content-Type", "text/html; charset=utf-8")
 					w.WriteHeader(http.StatusInternalServerError)
 					err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
@@ -216,85 +189,42 @@ func HandleObjectRequest(resolvedFolders map[string]string, config *ServerConfig
 				return
 			}
 			
-			// フォルダの内容を読み込み
-			entries, err := os.ReadDir(fullPath)
-			if err != nil {
-				log.Printf("Object: フォルダの読み込みに失敗しました: '%s' %v", fullPath, err)
-				w.Header().Set("Content-Type", "text/html; charset=utf-8")
-				w.WriteHeader(http.StatusInternalServerError)
-				err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
+			// ?download=のときはフォルダーをアーカイブにしてダウンロード
+			if format := r.URL.Query().Get("download"); format != "" {
+				if !isArchiveFormat(format) {
+					log.Printf("Object: 対応していないアーカイブ形式: '%s'", format)
+					http.Error(w, "Bad Request", http.StatusBadRequest)
+					return
+				}
+				handleFolderDownload(w, r, fullPath, format, config)
 				return
 			}
 
-			// フォルダとファイルのリストを組み立てる
-			var fileList	[]WS_FileEntry
-			var dirList		[]WS_FileEntry
-			for _, entry := range entries {
-				ignored, reason := isIgnored(entry.Name(), config.Ignores)
-				if ignored {
-					log.Printf("Object: 除外パス: '%s' (Reason: %s)", filepath.Join(fullPath, entry.Name()), reason)
-					continue
-				}
-				
-				info, _ := entry.Info()
-				isDir := entry.IsDir()
-				
-				// フォルダとファイルに分けて処理
-				if isDir {
-					dirList = append(dirList, WS_FileEntry{
-						WS_Name:        entry.Name(),
-//						WS_Link:		strings.ReplaceAll(url.PathEscape(entry.Name()), "+", "%20") + "/",
-						WS_Link:		url.PathEscape(entry.Name()) + "/",
-						WS_LastMod:     info.ModTime().Format("2006-01-02 15:04:05"),
-						WS_IsDirectory: true,
-//						WS_IconPath:	template.URL(strings.ReplaceAll(url.PathEscape(entry.Name()), "+", "%20") + ".icon"),
-						WS_IconPath:	template.URL(url.PathEscape(entry.Name()) + ".icon"),
-					})
-				} else {
-					// 映画と画像を検出
-					isMovie := IsMovieFile(entry.Name())
-					isImage := isImageFile(filepath.Join(fullPath, entry.Name()))
-					
-					fileList = append(fileList, WS_FileEntry{
-						WS_Name:        entry.Name(),
-						WS_Link:        getEntryPath(r.URL.Path, entry.Name(), isMovie, isImage),
-//						WS_Size:        formatSize(info.Size()),
-						WS_LastMod:     info.ModTime().Format("2006-01-02 15:04:05"),
-						WS_IsDirectory: false,
-						WS_IsMovie:     isMovie,
-						WS_IsImage:     isImage,
-						WS_IconPath:	template.URL(url.PathEscape(entry.Name()) + ".icon"),
-					})
+			// ?playlist=のときはフォルダーの動画・音声をプレイリストにしてダウンロード
+			if format := r.URL.Query().Get("playlist"); format != "" {
+				if !isPlaylistFormat(format) {
+					log.Printf("Object: 対応していないプレイリスト形式: '%s'", format)
+					http.Error(w, "Bad Request", http.StatusBadRequest)
+					return
 				}
+				handleFolderPlaylist(w, r, fullPath, format, config)
+				return
 			}
-			
-			// フォルダのリストとファイルのリストを結合
-			var combinedList []WS_FileEntry
-			combinedList = append(combinedList, dirList...)
-			combinedList = append(combinedList, fileList...)
-
-			// フォルダとファイルをまとめてソート
-			sort.Slice(combinedList, func(i, j int) bool {
-				return strings.ToLower(combinedList[i].WS_Name) < strings.ToLower(combinedList[j].WS_Name) //大文字小文字の区別なし
-			})
 
-			// 親フォルダのパスを生成
-			parentPath := ""
-			if r.URL.Path != "/" {
-				parentPath = filepath.Dir(r.URL.Path)
-				if parentPath == "." {
-					parentPath = "/"
-				} else {
-					parentPath += "/"
-				}
+			// ?icons=cssのときはフォルダーのアイコンを1つのCSSにまとめて送信
+			if r.URL.Query().Get("icons") == "css" {
+				handleFolderIconCSS(w, r, fullPath, config)
+				return
 			}
 
-			// テンプレートで利用する変数をまとめる
-			data := FolderData{
-				WS_Title:		filepath.Base(fullPath),
-				WS_Link:		r.URL.Path,
-				WS_ParentPath:	parentPath,
-				WS_Objects:		combinedList,
+			// フォルダの内容を読み込み
+			data, err := buildFolderData(r, fullPath, config)
+			if err != nil {
+				log.Printf("Object: フォルダの読み込みに失敗しました: '%s' %v", fullPath, err)
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.WriteHeader(http.StatusInternalServerError)
+				err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
+				return
 			}
 
 			//テンプレートでリスト表示
@@ -316,6 +246,186 @@ func HandleObjectRequest(resolvedFolders map[string]string, config *ServerConfig
 	}
 }
 
+// buildRootDataはルートフォルダーの一覧を組み立てます。
+func buildRootData(resolvedFolders map[string]string) FolderData {
+	var entries []WS_FileEntry
+	for name := range resolvedFolders {
+		entries = append(entries, WS_FileEntry{
+//					WS_Name:        name,
+//					WS_Link:        name,
+			WS_Name:        name,
+			WS_Link:		strings.ReplaceAll(url.PathEscape(name), "+", "%20") + "/",
+			WS_IsDirectory: true,
+		})
+	}
+	// フォルダとファイルをそれぞれソート
+	sortEntries(entries, sortOptions{Key: sortByName})
+	return FolderData{
+		WS_Title:		"Web Server",
+		WS_Link:		"/",
+		WS_ParentPath:	"",
+		WS_Objects:		entries,
+	}
+}
+
+// buildFolderDataはフォルダーの内容を読み込み、テンプレートに渡すデータを組み立てます。
+func buildFolderData(r *http.Request, fullPath string, config *ServerConfig) (FolderData, error) {
+	entries, err := os.ReadDir(fullPath)
+	if err != nil {
+		return FolderData{}, err
+	}
+
+	view := folderView(r, fullPath)
+	format := newLocaleFormatter(r)
+	folderPath := getRequestedPath(r)
+	viewer := viewerID(r)
+
+	// フォルダとファイルのリストを組み立てる
+	var fileList	[]WS_FileEntry
+	var dirList		[]WS_FileEntry
+	for _, entry := range entries {
+		ignored, reason := isIgnored(entry.Name(), config.Ignores)
+		if ignored {
+			log.Printf("Object: 除外パス: '%s' (Reason: %s)", filepath.Join(fullPath, entry.Name()), reason)
+			continue
+		}
+		
+		info, _ := entry.Info()
+		isDir := entry.IsDir()
+		
+		// フォルダとファイルに分けて処理
+		if isDir {
+			readState, resumeLink := readingState(viewer, folderPath+"/"+entry.Name(), config)
+			dirList = append(dirList, WS_FileEntry{
+				WS_Name:        entry.Name(),
+//						WS_Link:		strings.ReplaceAll(url.PathEscape(entry.Name()), "+", "%20") + "/",
+				WS_Link:		url.PathEscape(entry.Name()) + "/",
+				WS_LastMod:     info.ModTime().Format("2006-01-02 15:04:05"),
+				WS_LastModText:	format.date(info.ModTime()),
+				WS_IsDirectory: true,
+//						WS_IconPath:	template.URL(strings.ReplaceAll(url.PathEscape(entry.Name()), "+", "%20") + ".icon"),
+				WS_IconPath:	template.URL(url.PathEscape(entry.Name()) + ".icon"),
+				WS_ReadState:	readState,
+				WS_ResumeLink:	resumeLink,
+				modTime:		info.ModTime(),
+			})
+		} else {
+			// 映画と画像を検出
+			isMovie := IsMovieFile(entry.Name())
+			isImage := isImageFile(filepath.Join(fullPath, entry.Name()))
+			var thumbPath template.URL
+			if hasThumbnail(entry.Name()) {
+				thumbPath = thumbnailURL(entry.Name(), config)
+			}
+			
+			fileEntry := WS_FileEntry{
+				WS_Name:        entry.Name(),
+				WS_Link:        getEntryPath(r.URL.Path, entry.Name(), isMovie, isImage),
+				WS_Size:        format.size(info.Size()),
+				WS_Bytes:		info.Size(),
+				WS_LastMod:     info.ModTime().Format("2006-01-02 15:04:05"),
+				WS_LastModText:	format.date(info.ModTime()),
+				WS_MimeType:	mime.TypeByExtension(filepath.Ext(entry.Name())),
+				WS_IsDirectory: false,
+				WS_IsMovie:     isMovie,
+				WS_IsAudio:		IsAudioFile(entry.Name()),
+				WS_IsImage:     isImage,
+				WS_IconPath:	template.URL(url.PathEscape(entry.Name()) + ".icon"),
+				WS_ThumbPath:	thumbPath,
+				size:			info.Size(),
+				modTime:		info.ModTime(),
+			}
+
+			// 詳細表示のときは、画像の大きさと動画・音声の長さも調べる
+			if view == "detail" {
+				entryPath := filepath.Join(fullPath, entry.Name())
+				if isImage {
+					if width, height, err := imageDimensions(entryPath); err == nil {
+						fileEntry.WS_Dimensions = fmt.Sprintf("%d × %d", width, height)
+					}
+				} else if isMovie || fileEntry.WS_IsAudio {
+					if duration, err := movieDuration(r.Context(), entryPath, info, config); err == nil {
+						fileEntry.WS_Duration = formatDuration(duration)
+					} else {
+						log.Printf("Object: 動画の長さの取得に失敗しました: '%s' %v", entryPath, err)
+					}
+				}
+			}
+
+			// 見ている途中の動画には、再生位置を表示する
+			if viewer != "" && isMovie {
+				filePath := folderPath + "/" + entry.Name()
+				if progress, ok := getProgressStore(config).get(viewer, filePath); ok {
+					fileEntry.WS_Progress = watchProgress(filePath, progress).WS_Percent
+					// 長さが分からないときもバッジを表示する
+					if fileEntry.WS_Progress == 0 {
+						fileEntry.WS_Progress = 1
+					}
+				}
+			}
+
+			// フォルダーとして開けるアーカイブには、読書状態を表示する
+			if isBrowsableArchive(entry.Name()) {
+				fileEntry.WS_ReadState, fileEntry.WS_ResumeLink = readingState(viewer, folderPath+"/"+entry.Name(), config)
+			}
+			fileList = append(fileList, fileEntry)
+		}
+	}
+	
+	// フォルダのリストとファイルのリストを結合
+	var combinedList []WS_FileEntry
+	combinedList = append(combinedList, dirList...)
+	combinedList = append(combinedList, fileList...)
+
+	// フォルダとファイルをまとめてソート
+	sortOpts := getSortOptions(r, config)
+	sortEntries(combinedList, sortOpts)
+	order := "asc"
+	if sortOpts.Desc {
+		order = "desc"
+	}
+	query := listingQuery(r)
+
+	// 親フォルダのパスを生成
+	parentPath := ""
+	if r.URL.Path != "/" {
+		parentPath = filepath.Dir(strings.TrimSuffix(r.URL.Path, "/"))
+		if parentPath == "." || parentPath == "/" {
+			parentPath = "/"
+		} else {
+			parentPath += "/"
+		}
+	}
+
+	// このフォルダーのしおり
+	resumeLink, resumeText := folderBookmark(viewer, folderPath, config)
+
+	// アイコンを1つのCSSにまとめるときは、項目ごとのクラス名を付ける
+	var iconCSS template.URL
+	if useIconSprite(config) {
+		iconCSS = "?icons=css"
+		for i := range combinedList {
+			combinedList[i].WS_IconClass = iconClassFor(filepath.Join(fullPath, combinedList[i].WS_Name), config)
+		}
+	}
+
+	// テンプレートで利用する変数をまとめる
+	return FolderData{
+		WS_Title:		filepath.Base(fullPath),
+		WS_Link:		r.URL.Path,
+		WS_ParentPath:	parentPath,
+		WS_View:		view,
+		WS_Sort:		sortOpts.Key,
+		WS_Order:		order,
+		WS_Query:		template.URL(query.Encode()),
+		WS_Objects:		combinedList,
+		WS_ResumeLink:	resumeLink,
+		WS_ResumeText:	resumeText,
+		WS_IconCSS:		iconCSS,
+		query:			query,
+	}, nil
+}
+
 // formatSizeはバイト単位のサイズを読みやすい形式に変換します。
 func formatSize(size int64) string {
 	if size < 1024 {
@@ -330,6 +440,19 @@ func formatSize(size int64) string {
 	return fmt.Sprintf("%.2f GB", float64(size)/1024/1024/1024)
 }
 
+// folderViewはフォルダーの表示モードを決めます。
+// ?view=list|grid|detailでリクエストごとに指定でき、無いときは__option_grid__ファイルがあればグリッド表示になります。
+func folderView(r *http.Request, fullPath string) string {
+	switch view := r.URL.Query().Get("view"); view {
+	case "list", "grid", "detail":
+		return view
+	}
+	if _, err := os.Stat(filepath.Join(fullPath, "__option_grid__")); err == nil {
+		return "grid"
+	}
+	return "list"
+}
+
 // getEntryPathは、ファイルの種類に応じて適切なパスを返します。
 func getEntryPath(basePath, entryName string, isMovie, isImage bool) string {
 
@@ -340,23 +463,17 @@ func getEntryPath(basePath, entryName string, isMovie, isImage bool) string {
 	if isMovie {
 		return encodedEntryName + ".movie.html"
 	}
+	if IsAudioFile(entryName) {
+		return encodedEntryName + ".audio.html"
+	}
+	if isPlaylistFile(entryName) {
+		return encodedEntryName + ".playlist.html"
+	}
 	if isImage {
 		return encodedEntryName + ".image.html"
 	}
-	return encodedEntryName
-}
-
-// エイリアス情報の取り出し
-func resolveAlias(path string) (string, error) {
-	cmd := exec.Command("./Libraries/resolveAlias", path) //自作コマンド
-	var out, stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-
-	err := cmd.Run()
-	if err != nil {
-		return "", fmt.Errorf("Error: %s", strings.TrimSpace(stderr.String()))
+	if isBrowsableArchive(entryName) {
+		return encodedEntryName + "/" // アーカイブはフォルダーとしてブラウズする
 	}
-
-	return strings.TrimSpace(out.String()), nil
+	return encodedEntryName
 }
@@ -0,0 +1,302 @@
+// Functions/playlist.go:プレイリスト:Functions/playlist.go
+//
+// folder/?playlist=m3u|m3u8 でフォルダーの動画・音声を拡張M3Uのプレイリストにしてダウンロードする
+// &recursive=1 を付けるとサブフォルダーも含める。VLCやmpvで開けるように、URLは絶対URLにする
+// フォルダーにある.m3u・.m3u8ファイルは、<ファイル>.playlist.html でプレイヤーのページとして表示する
+//
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// recursive=1のときの上限
+const (
+	playlistMaxDepth	= 8		// たどるサブフォルダーの深さ
+	playlistMaxItems	= 5000	// プレイリストの項目の数
+)
+
+// playlistItemはプレイリストの1つの項目です。
+type playlistItem struct {
+	title		string
+	link		string	// 絶対URL
+	duration	int		// 秒（分からないときは-1）
+}
+
+// isPlaylistFormatはダウンロードできるプレイリスト形式かどうかを返します。
+func isPlaylistFormat(format string) bool {
+	return format == "m3u" || format == "m3u8"
+}
+
+// isPlaylistFileはM3Uのプレイリストファイルかどうかを返します。
+func isPlaylistFile(filePath string) bool {
+	ext := strings.ToLower(filepath.Ext(filePath))
+	return ext == ".m3u" || ext == ".m3u8"
+}
+
+// requestBaseURLはリクエストされたサーバーの"http://host:port"を返します。
+// リバースプロキシの後ろにいるときは、X-Forwarded-Protoに従います。
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// handleFolderPlaylistはフォルダーの動画・音声を拡張M3Uのプレイリストにして送信します。
+func handleFolderPlaylist(w http.ResponseWriter, r *http.Request, fullPath string, format string, config *ServerConfig) {
+	recursive := r.URL.Query().Get("recursive") == "1"
+	folderURL := requestBaseURL(r) + r.URL.EscapedPath()
+	if !strings.HasSuffix(folderURL, "/") {
+		folderURL += "/"
+	}
+
+	var items []playlistItem
+	if err := collectPlaylistItems(r.Context(), fullPath, folderURL, recursive, 0, getSortOptions(r, config), config, &items); err != nil {
+		log.Printf("Playlist: フォルダの読み込みに失敗しました: '%s' %v", fullPath, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	fileName := filepath.Base(fullPath) + "." + format
+	w.Header().Set("Content-Type", "audio/x-mpegurl; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename*=UTF-8''%s`, url.PathEscape(fileName)))
+	w.Header().Set("Cache-Control", "no-cache")
+
+	log.Printf("Playlist: プレイリストの送信: '%s' (%d 項目)", fullPath, len(items))
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	for _, item := range items {
+		fmt.Fprintf(&b, "#EXTINF:%d,%s\n%s\n", item.duration, item.title, item.link)
+	}
+	w.Write([]byte(b.String()))
+}
+
+// collectPlaylistItemsはフォルダーの動画・音声を、フォルダーリストと同じ並び順でitemsに追加します。
+// recursiveのときは、ファイルの後にサブフォルダーの中身を続けます（playlistMaxDepthの深さ、playlistMaxItemsの数まで）。
+// recursiveのときはffprobeを使わず、情報を取得済みのファイルだけ長さと曲名を書きます。
+func collectPlaylistItems(ctx context.Context, dir string, dirURL string, recursive bool, depth int, sortOpts sortOptions, config *ServerConfig, items *[]playlistItem) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var files, folders []sortItem
+	for _, entry := range entries {
+		if ignored, _ := isIgnored(entry.Name(), config.Ignores); ignored {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		item := sortItem{name: entry.Name(), isDir: info.IsDir(), size: info.Size(), modTime: info.ModTime()}
+		switch {
+		case info.IsDir():
+			folders = append(folders, item)
+		case info.Mode().IsRegular() && (IsMovieFile(entry.Name()) || IsAudioFile(entry.Name())):
+			files = append(files, item)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool { return sortOpts.less(files[i], files[j]) })
+	sort.SliceStable(folders, func(i, j int) bool { return sortOpts.less(folders[i], folders[j]) })
+
+	for _, file := range files {
+		if len(*items) >= playlistMaxItems {
+			log.Printf("Playlist: 項目が多すぎるため %d 項目までにします: '%s'", playlistMaxItems, dir)
+			return nil
+		}
+		entryPath := filepath.Join(dir, file.name)
+		item := playlistItem{
+			title:		strings.TrimSuffix(file.name, filepath.Ext(file.name)),
+			link:		dirURL + url.PathEscape(file.name) + "?original=1",
+			duration:	-1,
+		}
+		if info, err := os.Stat(entryPath); err == nil {
+			var probe *movieProbe
+			if recursive {
+				probe, _ = movieProbeCache.get(entryPath, info)
+			} else {
+				probe, _ = probeMovie(ctx, entryPath, info, config)
+			}
+			if probe != nil {
+				if duration := probe.duration(); duration > 0 {
+					item.duration = int(duration + 0.5)
+				}
+				if title := probe.tag("title"); title != "" && IsAudioFile(file.name) {
+					item.title = title
+					if artist := probe.tag("artist"); artist != "" {
+						item.title = artist + " - " + title
+					}
+				}
+			}
+		}
+		// 改行が入るとプレイリストが壊れるので取り除く
+		item.title = strings.Join(strings.Fields(item.title), " ")
+		*items = append(*items, item)
+	}
+
+	if recursive && depth < playlistMaxDepth {
+		for _, folder := range folders {
+			if len(*items) >= playlistMaxItems || ctx.Err() != nil {
+				break
+			}
+			subURL := dirURL + url.PathEscape(folder.name) + "/"
+			if err := collectPlaylistItems(ctx, filepath.Join(dir, folder.name), subURL, recursive, depth+1, sortOpts, config, items); err != nil {
+				log.Printf("Playlist: フォルダの読み込みに失敗しました: '%s' %v", filepath.Join(dir, folder.name), err)
+			}
+		}
+	}
+	return nil
+}
+
+// HandlePlaylistPageは.m3u・.m3u8ファイルをプレイヤーのページとして表示します。
+func HandlePlaylistPage(resolvedFolders map[string]string, config *ServerConfig, playlistTmpl *template.Template, err404Tmpl *template.Template) http.HandlerFunc {
+	paths := newPathResolver(resolvedFolders, config)
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestedPath := getRequestedPath(r)
+
+		log.Printf("Playlist: プレイリストのページ: '%s'", requestedPath)
+
+		// 元のプレイリストファイルのパスを取得するために.playlist.htmlを削除
+		originalPath := strings.TrimSuffix(requestedPath, ".playlist.html")
+		fullPath, _, ok := paths.resolveFile(originalPath)
+		if !ok || !isPlaylistFile(fullPath) {
+			log.Printf("Playlist: 404: '%s'", requestedPath)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusNotFound)
+			err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
+			return
+		}
+
+		data, err := buildPlaylistData(r, originalPath, fullPath, paths)
+		if err != nil {
+			log.Printf("Playlist: ファイルの読み込みに失敗しました: '%s' %v", fullPath, err)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := playlistTmpl.Execute(w, data); err != nil {
+			log.Printf("Playlist: テンプレートの実行に失敗しました: %v", err)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusInternalServerError)
+			err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
+		}
+	}
+}
+
+// buildPlaylistDataはプレイリストファイルを読み込み、プレイヤーのページに渡すデータを組み立てます。
+// リンクはr.URL.Path（.playlist.htmlのURL）を基準にします。
+func buildPlaylistData(r *http.Request, originalPath string, fullPath string, paths pathResolver) (PlaylistTemplateData, error) {
+	content, err := os.ReadFile(fullPath)
+	if err != nil {
+		return PlaylistTemplateData{}, err
+	}
+	return PlaylistTemplateData{
+		WS_Title:	filepath.Base(originalPath),
+		WS_BaseURL:	template.URL(filepath.Dir(r.URL.Path) + "/"),
+		WS_Entries:	parseM3U(decodeSubtitleText(content), path.Dir(originalPath), paths),
+	}, nil
+}
+
+// parseM3UはM3Uの内容を読み込み、再生できるリンクの一覧にします。
+// 相対パスはプレイリストのフォルダー（playlistDir、URLのパス）から、絶対パスは公開されているフォルダーから探します。
+func parseM3U(text string, playlistDir string, paths pathResolver) []PlaylistEntry {
+	var entries []PlaylistEntry
+	var title string
+	duration := -1.0
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "#EXTINF:"):
+			// "#EXTINF:123,アーティスト - 曲名"
+			info, name, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			title = strings.TrimSpace(name)
+			if value, err := strconv.ParseFloat(strings.Fields(info + " ")[0], 64); err == nil {
+				duration = value
+			}
+			continue
+		case strings.HasPrefix(line, "#"):
+			continue
+		}
+
+		entry := resolveM3UEntry(line, playlistDir, paths)
+		if title != "" {
+			entry.WS_Title = title
+		}
+		if duration > 0 {
+			entry.WS_Duration = formatDuration(duration)
+		}
+		entries = append(entries, entry)
+		title, duration = "", -1
+	}
+	return entries
+}
+
+// resolveM3UEntryはプレイリストの1行を、リンクに変換します。
+func resolveM3UEntry(location string, playlistDir string, paths pathResolver) PlaylistEntry {
+	entry := PlaylistEntry{WS_Title: location}
+
+	// インターネット上のURLはそのまま使う
+	if u, err := url.Parse(location); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		entry.WS_Link = location
+		entry.WS_Title = path.Base(u.Path)
+		return entry
+	} else if err == nil && u.Scheme == "file" {
+		location = u.Path
+	}
+
+	// Windowsで作られたプレイリストの区切り文字をそろえる
+	location = strings.ReplaceAll(location, `\`, "/")
+	entry.WS_Title = strings.TrimSuffix(path.Base(location), path.Ext(location))
+
+	var urlPath string
+	if strings.HasPrefix(location, "/") || (len(location) > 2 && location[1] == ':' && location[2] == '/') {
+		// 絶対パスは、公開されているフォルダーの中にあるときだけ使う
+		for name, root := range paths.folders {
+			if fullPath := filepath.FromSlash(location); isWithinDir(root, fullPath) {
+				rel, _ := filepath.Rel(root, fullPath)
+				urlPath = path.Join(name, filepath.ToSlash(rel))
+				break
+			}
+		}
+	} else {
+		urlPath = path.Join(playlistDir, location)
+	}
+
+	fullPath, _, ok := paths.resolveFile(urlPath)
+	if urlPath == "" || !ok || !(IsMovieFile(fullPath) || IsAudioFile(fullPath)) {
+		entry.WS_Missing = true
+		return entry
+	}
+
+	entry.WS_Link = "/" + escapeURLPath(urlPath)
+	entry.WS_IsAudio = IsAudioFile(fullPath)
+	if entry.WS_IsAudio {
+		entry.WS_Page = entry.WS_Link + ".audio.html"
+	} else {
+		entry.WS_Page = entry.WS_Link + ".movie.html"
+	}
+	return entry
+}
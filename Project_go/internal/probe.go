@@ -0,0 +1,239 @@
+// Functions/probe.go:動画の情報取得:Functions/probe.go
+//
+// ffprobeで動画・音声ファイルの長さ・大きさ・ストリーム・タグの情報を取得する
+// 取得した情報は、ファイルが更新されるまでメモリーにキャッシュする（最近使われたものから決まった数まで）
+//
+
+package internal
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// movieProbeはffprobeで取得した動画の情報です。
+type movieProbe struct {
+	Format		probeFormat		`json:"format"`
+	Streams		[]probeStream	`json:"streams"`
+	Chapters	[]probeChapter	`json:"chapters"`
+}
+
+// probeFormatはコンテナの情報です。
+type probeFormat struct {
+	Duration	string	`json:"duration"`
+	BitRate		string	`json:"bit_rate"`
+	FormatName	string				`json:"format_name"`
+	Tags		map[string]string	`json:"tags"`
+}
+
+// probeStreamは映像・音声・字幕などのストリームの情報です。
+type probeStream struct {
+	Index		int					`json:"index"`
+	CodecType	string				`json:"codec_type"`	// "video"、"audio"、"subtitle"など
+	CodecName	string				`json:"codec_name"`
+	Profile		string				`json:"profile"`
+	PixFmt		string				`json:"pix_fmt"`
+	Width		int					`json:"width"`
+	Height		int					`json:"height"`
+	FrameRate	string				`json:"avg_frame_rate"`	// "30000/1001"のような分数
+	Channels	int					`json:"channels"`
+	BitRate		string				`json:"bit_rate"`
+	Tags		map[string]string	`json:"tags"`
+	Disposition	map[string]int		`json:"disposition"`
+}
+
+// probeChapterはチャプターの情報です。
+type probeChapter struct {
+	StartTime	string				`json:"start_time"`
+	EndTime		string				`json:"end_time"`
+	Tags		map[string]string	`json:"tags"`
+}
+
+// メモリーに保存する動画の情報の数
+const movieProbeEntries = 4096
+
+// probeCacheは動画の情報のLRUキャッシュです。パスごとに1つだけ保存し、更新日時が変わったら取り直します。
+type probeCache struct {
+	mu		sync.Mutex
+	entries	map[string]*list.Element	// パス -> LRUリストの要素
+	lru		*list.List					// 先頭が最も新しく使われたもの
+}
+
+// probeCacheEntryはキャッシュされた1つの動画の情報です。
+type probeCacheEntry struct {
+	path	string
+	modTime	time.Time
+	probe	*movieProbe
+}
+
+var movieProbeCache = &probeCache{entries: make(map[string]*list.Element), lru: list.New()}
+
+// getは更新日時が同じ動画の情報があれば返します。
+func (c *probeCache) get(filePath string, info os.FileInfo) (*movieProbe, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[filePath]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*probeCacheEntry)
+	if !entry.modTime.Equal(info.ModTime()) {
+		// ファイルが更新されたので古い情報は捨てる
+		c.lru.Remove(elem)
+		delete(c.entries, filePath)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.probe, true
+}
+
+// putは動画の情報を保存し、上限を超えたら最も古く使われたものを捨てます。
+func (c *probeCache) put(filePath string, info os.FileInfo, probe *movieProbe) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := &probeCacheEntry{path: filePath, modTime: info.ModTime(), probe: probe}
+	if elem, ok := c.entries[filePath]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[filePath] = c.lru.PushFront(entry)
+	for c.lru.Len() > movieProbeEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*probeCacheEntry).path)
+	}
+}
+
+// probeMovieはffprobeで動画の情報を取得します。
+// ffprobeは短い処理の同時実行数の制限（transcode.goのgetToolLimiter）の中で実行します。
+func probeMovie(ctx context.Context, filePath string, info os.FileInfo, config *ServerConfig) (*movieProbe, error) {
+	if probe, ok := movieProbeCache.get(filePath, info); ok {
+		return probe, nil
+	}
+
+	release, err := getToolLimiter(config).acquire(ctx, "probe", filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	cmd := exec.CommandContext(ctx, "ffprobe",
+		"-v", "error",
+		"-show_format",
+		"-show_streams",
+		"-show_chapters",
+		"-of", "json",
+		filePath)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobeコマンドの実行に失敗しました: %w", err)
+	}
+	var probe movieProbe
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return nil, fmt.Errorf("ffprobeの出力を読み込めません: %w", err)
+	}
+	movieProbeCache.put(filePath, info, &probe)
+	return &probe, nil
+}
+
+// durationは動画の長さ（秒）を返します。
+func (p *movieProbe) duration() float64 {
+	duration, _ := strconv.ParseFloat(p.Format.Duration, 64)
+	return duration
+}
+
+// frameRateは映像のフレームレートを返します。分からないときは0を返します。
+func (s probeStream) frameRate() float64 {
+	num, den, ok := strings.Cut(s.FrameRate, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !ok {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// videoStreamは最初の映像ストリームを返します。カバー画像は除きます。
+func (p *movieProbe) videoStream() (probeStream, bool) {
+	for _, stream := range p.Streams {
+		if stream.CodecType == "video" && stream.Disposition["attached_pic"] == 0 {
+			return stream, true
+		}
+	}
+	return probeStream{}, false
+}
+
+// audioStreamsは全ての音声ストリームを返します。
+func (p *movieProbe) audioStreams() []probeStream {
+	var streams []probeStream
+	for _, stream := range p.Streams {
+		if stream.CodecType == "audio" {
+			streams = append(streams, stream)
+		}
+	}
+	return streams
+}
+
+// audioStreamは最初の音声ストリームを返します。
+func (p *movieProbe) audioStream() (probeStream, bool) {
+	for _, stream := range p.Streams {
+		if stream.CodecType == "audio" {
+			return stream, true
+		}
+	}
+	return probeStream{}, false
+}
+
+// coverStreamは埋め込まれたカバー画像のストリームを返します。
+func (p *movieProbe) coverStream() (probeStream, bool) {
+	for _, stream := range p.Streams {
+		if stream.CodecType == "video" && stream.Disposition["attached_pic"] != 0 {
+			return stream, true
+		}
+	}
+	return probeStream{}, false
+}
+
+// tagはタグの値を返します。名前の大文字・小文字は区別しません。
+// コンテナのタグに無いときは、音声ストリームのタグ（Ogg Vorbisなど）から探します。
+func (p *movieProbe) tag(name string) string {
+	tags := []map[string]string{p.Format.Tags}
+	if audio, ok := p.audioStream(); ok {
+		tags = append(tags, audio.Tags)
+	}
+	for _, t := range tags {
+		for key, value := range t {
+			if strings.EqualFold(key, name) {
+				return strings.TrimSpace(value)
+			}
+		}
+	}
+	return ""
+}
+
+// movieDurationは動画の長さ（秒）を取得します。
+func movieDuration(ctx context.Context, filePath string, info os.FileInfo, config *ServerConfig) (float64, error) {
+	probe, err := probeMovie(ctx, filePath, info, config)
+	if err != nil {
+		return 0, err
+	}
+	duration := probe.duration()
+	if duration <= 0 {
+		return 0, fmt.Errorf("動画の長さを取得できません: '%s'", filePath)
+	}
+	return duration, nil
+}
@@ -0,0 +1,214 @@
+// Functions/progress.go:再生位置の保存:Functions/progress.go
+//
+// 動画をどこまで見たかを、閲覧者（ブラウザーのクッキー）ごとに作業用フォルダーのprogress.jsonに保存する
+// movie.htmlが再生中に /api/v1/progress/<パス> へ定期的に送信し、次に開いたときは続きから再生する
+// フォルダーリストには「続きから」のバッジを、トップページには見ている途中の動画の一覧を表示する
+//
+
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 再生位置の保存に関する値
+const (
+	viewerCookieName		= "ws_viewer"			// 閲覧者を見分けるクッキー
+	progressMinPosition		= 10					// これより前で止めたときは保存しない（秒）
+	progressFinishedRatio	= 0.95					// ここまで見たら見終わったものとして消す
+	progressMaxEntries		= 200					// 閲覧者ごとに保存する数
+	progressListLimit		= 12					// トップページに表示する数
+	progressSaveDelay		= 5 * time.Second		// 書き込みをまとめる間隔
+)
+
+// progressEntryは1つのファイルの再生位置です。
+type progressEntry struct {
+	Position	float64		`json:"position"`			// 秒
+	Duration	float64		`json:"duration,omitempty"`	// 秒
+	Updated		time.Time	`json:"updated"`
+}
+
+// progressStoreは閲覧者ごとの再生位置を、ファイルの仮想パスをキーにして保存します。
+type progressStore struct {
+	*viewerStore[progressEntry]
+}
+
+// updatedAtは古いものから消すための更新日時を返します。
+func (e progressEntry) updatedAt() time.Time {
+	return e.Updated
+}
+
+var (
+	progressStoreOnce	sync.Once
+	progressStoreInst	progressStore
+)
+
+// getProgressStoreは再生位置の保存先を返します。最初に呼ばれたときにファイルから読み込みます。
+func getProgressStore(config *ServerConfig) progressStore {
+	progressStoreOnce.Do(func() {
+		progressStoreInst = progressStore{newViewerStore[progressEntry]("Progress",
+			filepath.Join(config.Config.Temporary, "progress.json"), progressMaxEntries, progressSaveDelay)}
+	})
+	return progressStoreInst
+}
+
+// setPositionは再生位置を保存します。始めのほうや、見終わったときは保存せずに消します。
+func (s progressStore) setPosition(viewer string, filePath string, position float64, duration float64) (progressEntry, bool) {
+	if position < progressMinPosition || (duration > 0 && position >= duration*progressFinishedRatio) {
+		s.remove(viewer, filePath)
+		return progressEntry{}, false
+	}
+	entry := s.set(viewer, filePath, func(progressEntry, bool) progressEntry {
+		return progressEntry{Position: position, Duration: duration, Updated: time.Now()}
+	})
+	return entry, true
+}
+
+// viewerIDはクッキーから閲覧者のIDを返します。クッキーが無いときは空を返します。
+// 画像ビューアのしおり（bookmark.go）でも、同じIDで閲覧者を見分けます。
+func viewerID(r *http.Request) string {
+	cookie, err := r.Cookie(viewerCookieName)
+	if err != nil {
+		return ""
+	}
+	if _, err := hex.DecodeString(cookie.Value); err != nil || len(cookie.Value) != 32 {
+		return ""
+	}
+	return cookie.Value
+}
+
+// ensureViewerIDは閲覧者のIDを返します。クッキーが無いときは新しく作って送ります。
+func ensureViewerID(w http.ResponseWriter, r *http.Request) string {
+	if viewer := viewerID(r); viewer != "" {
+		return viewer
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	viewer := hex.EncodeToString(id)
+	http.SetCookie(w, &http.Cookie{
+		Name:		viewerCookieName,
+		Value:		viewer,
+		Path:		"/",
+		MaxAge:		365 * 24 * 60 * 60,
+		HttpOnly:	true,
+		SameSite:	http.SameSiteLaxMode,
+	})
+	return viewer
+}
+
+// watchProgressは保存されている再生位置を、テンプレートやAPIに渡す形にします。
+func watchProgress(filePath string, entry progressEntry) WatchProgress {
+	link := "/" + escapeURLPath(filePath)
+	progress := WatchProgress{
+		WS_Name:			path.Base(filePath),
+		WS_Path:			filePath,
+		WS_Link:			link + ".movie.html",
+		WS_ThumbPath:		link + ".thumb",
+		WS_Position:		entry.Position,
+		WS_PositionText:	formatDuration(entry.Position),
+		WS_Duration:		entry.Duration,
+		WS_Updated:			entry.Updated.Format("2006-01-02 15:04:05"),
+	}
+	if entry.Duration > 0 {
+		progress.WS_Percent = int(entry.Position / entry.Duration * 100)
+	}
+	return progress
+}
+
+// continueWatchingは閲覧者が見ている途中の動画を、新しい順に返します。無くなったファイルは除きます。
+func continueWatching(r *http.Request, paths pathResolver, config *ServerConfig, limit int) []WatchProgress {
+	viewer := viewerID(r)
+	if viewer == "" {
+		return nil
+	}
+	filePaths, entries := getProgressStore(config).recent(viewer)
+	var list []WatchProgress
+	for _, filePath := range filePaths {
+		if limit > 0 && len(list) >= limit {
+			break
+		}
+		// 以前のバージョンで保存された音声の再生位置は表示しない
+		target, ok := paths.resolve(filePath)
+		if !ok || !target.isFile() || !IsMovieFile(target.fullPath) {
+			continue
+		}
+		list = append(list, watchProgress(filePath, entries[filePath]))
+	}
+	return list
+}
+
+// handleProgressAPIは /api/v1/progress/ 以下のリクエストを処理します。
+//
+//	GET    /api/v1/progress/			見ている途中の動画の一覧
+//	GET    /api/v1/progress/<パス>		ファイルの再生位置
+//	POST   /api/v1/progress/<パス>		再生位置を保存する {"position": 秒, "duration": 秒}
+//	DELETE /api/v1/progress/<パス>		再生位置を消す
+func handleProgressAPI(w http.ResponseWriter, r *http.Request, paths pathResolver, requestedPath string, config *ServerConfig) {
+	store := getProgressStore(config)
+
+	if requestedPath == "" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		list := continueWatching(r, paths, config, 0)
+		if list == nil {
+			list = []WatchProgress{}
+		}
+		writeJSON(w, http.StatusOK, list)
+		return
+	}
+
+	// 保存するのは動画だけ（短い音声で上限が埋まって、見ている途中の動画が消えないように）
+	target, ok := paths.resolve(requestedPath)
+	if !ok || !target.isFile() || !IsMovieFile(target.fullPath) {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	filePath := target.virtualPath()
+
+	switch r.Method {
+	case http.MethodGet:
+		entry, ok := store.get(viewerID(r), filePath)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "no progress")
+			return
+		}
+		writeJSON(w, http.StatusOK, watchProgress(filePath, entry))
+
+	case http.MethodPost, http.MethodPut:
+		// navigator.sendBeaconはContent-Typeを指定できないので、ヘッダーは見ない
+		var body struct {
+			Position	float64	`json:"position"`
+			Duration	float64	`json:"duration"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&body); err != nil || body.Position < 0 || body.Duration < 0 {
+			writeJSONError(w, http.StatusBadRequest, "invalid progress")
+			return
+		}
+		viewer := ensureViewerID(w, r)
+		entry, saved := store.setPosition(viewer, filePath, body.Position, body.Duration)
+		if !saved {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, http.StatusOK, watchProgress(filePath, entry))
+
+	case http.MethodDelete:
+		store.remove(viewerID(r), filePath)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, PUT, DELETE")
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,118 @@
+// Functions/resolver.go:仮想パスの解決:Functions/resolver.go
+//
+// URLの仮想パス（<ルートフォルダー名>/<サブパス>）を、実際のパスに変換する
+// 全てのハンドラーとAPIがこれを使うので、区切り文字・..・シンボリックリンク（linkpolicy.go）の扱いはどこでも同じになる
+// 結果には、ルートフォルダー・相対パス・os.Statの結果・種類（ファイル、フォルダー、アーカイブの中など）をまとめて返す
+//
+
+package internal
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// pathKindは仮想パスが指しているものの種類です。
+type pathKind int
+
+const (
+	pathMissing		pathKind = iota	// 存在しない
+	pathFile						// 通常のファイル
+	pathDir							// フォルダー
+	pathInArchive					// アーカイブの中の項目（archivePathとinnerを参照）
+	pathOther						// 通常のファイル・フォルダー以外（デバイスなど）
+)
+
+// pathTargetは仮想パスを解決した結果です。
+type pathTarget struct {
+	rootName	string		// URLの最初の階層（ルートフォルダー名）
+	root		string		// ルートフォルダーの実際のパス
+	rel			string		// ルートフォルダーからの相対パス（/区切り。ルートフォルダー自体のときは空）
+	fullPath	string		// 実際のパス
+	info		os.FileInfo	// os.Statの結果。存在しないときやアーカイブの中のときはnil
+	kind		pathKind
+	archivePath	string		// pathInArchiveのとき、アーカイブのパス
+	inner		string		// pathInArchiveのとき、アーカイブの中のパス（/区切り）
+}
+
+// isFileは、通常のファイルかどうかを返します。
+func (p pathTarget) isFile() bool {
+	return p.kind == pathFile
+}
+
+// virtualPathは正規化した仮想パス（<ルートフォルダー名>/<相対パス>）を返します。
+// 再生位置やしおりは、これをキーにして保存します。
+func (p pathTarget) virtualPath() string {
+	if p.rel == "" {
+		return p.rootName
+	}
+	return p.rootName + "/" + p.rel
+}
+
+// pathResolverは公開フォルダーの一覧を基に、仮想パスを実際のパスに変換します。
+type pathResolver struct {
+	folders	map[string]string	// ルートフォルダー名と実際のパス
+	config	*ServerConfig
+}
+
+// newPathResolverはpathResolverを作ります。ハンドラーを作るときに1つずつ作ってください。
+func newPathResolver(resolvedFolders map[string]string, config *ServerConfig) pathResolver {
+	return pathResolver{folders: resolvedFolders, config: config}
+}
+
+// resolveは仮想パスを実際のパスに変換します。区切り文字は/と、このOSの区切り文字のどちらでもかまいません。
+// 公開フォルダーに無いとき、..で公開フォルダーの外に出るとき、シンボリックリンクの設定で許されていないときはfalseを返します。
+// 存在しないパスはtrueとkindがpathMissingの結果を返します。
+func (p pathResolver) resolve(virtualPath string) (pathTarget, bool) {
+	clean := path.Clean("/" + filepath.ToSlash(virtualPath))
+	if clean == "/" {
+		return pathTarget{}, false
+	}
+	rootName, rel, _ := strings.Cut(clean[1:], "/")
+	root, ok := p.folders[rootName]
+	if !ok {
+		return pathTarget{}, false
+	}
+	fullPath := root
+	if rel != "" {
+		fullPath = filepath.Join(root, filepath.FromSlash(rel))
+	}
+	if !linkAllowed(root, fullPath, p.folders, p.config) {
+		return pathTarget{}, false
+	}
+
+	result := pathTarget{
+		rootName:	rootName,
+		root:		root,
+		rel:		rel,
+		fullPath:	fullPath,
+	}
+	info, err := os.Stat(fullPath)
+	switch {
+	case err == nil && info.Mode().IsRegular():
+		result.info, result.kind = info, pathFile
+	case err == nil && info.IsDir():
+		result.info, result.kind = info, pathDir
+	case err == nil:
+		result.info, result.kind = info, pathOther
+	default:
+		// アーカイブの中のパスは、アーカイブが公開フォルダーの中にあるときだけ
+		if archivePath, inner, ok := findArchivePath(fullPath); ok && isWithinDir(result.root, archivePath) {
+			result.kind, result.archivePath, result.inner = pathInArchive, archivePath, inner
+		} else {
+			result.kind = pathMissing
+		}
+	}
+	return result, true
+}
+
+// resolveFileは仮想パスが通常のファイルのときだけ、実際のパスとos.Statの結果を返します。
+func (p pathResolver) resolveFile(virtualPath string) (string, os.FileInfo, bool) {
+	target, ok := p.resolve(virtualPath)
+	if !ok || !target.isFile() {
+		return "", nil, false
+	}
+	return target.fullPath, target.info, true
+}
@@ -0,0 +1,238 @@
+// Functions/resolver_test.go:仮想パスの解決のテスト:Functions/resolver_test.go
+//
+// 一時フォルダーに公開フォルダー・アーカイブ・シンボリックリンクを作り、pathResolver.resolveの結果を調べる
+//
+
+package internal
+
+import (
+	"archive/zip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// resolverFixtureはテスト用の公開フォルダーを作り、ルートフォルダー名と実際のパスを返します。
+//
+//	A/           公開フォルダー（file.txt、sub/inner.txt、book.zip、各種リンク）
+//	B/           公開フォルダー（b.txt）
+//	L            Aへのリンクの公開フォルダー
+//	Z            zipped.zipの中を指す公開フォルダー（アーカイブが公開フォルダーの外）
+//	outside/     公開フォルダーの外（secret.txt、out.zip）
+func resolverFixture(t *testing.T) (string, map[string]string) {
+	t.Helper()
+	base := t.TempDir()
+	mkdir := func(name string) {
+		if err := os.MkdirAll(filepath.Join(base, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(name string) {
+		if err := os.WriteFile(filepath.Join(base, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeZip := func(name string, entries ...string) {
+		f, err := os.Create(filepath.Join(base, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		zw := zip.NewWriter(f)
+		for _, entry := range entries {
+			w, err := zw.Create(entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Write([]byte(entry))
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	symlink := func(target string, name string) {
+		if err := os.Symlink(target, filepath.Join(base, name)); err != nil {
+			t.Skipf("シンボリックリンクを作れません: %v", err)
+		}
+	}
+
+	mkdir("A/sub")
+	mkdir("B")
+	mkdir("outside")
+	write("A/file.txt")
+	write("A/sub/inner.txt")
+	write("B/b.txt")
+	write("outside/secret.txt")
+	writeZip("A/book.zip", "page1.jpg", "ch1/page2.jpg")
+	writeZip("outside/out.zip", "page1.jpg")
+	writeZip("zipped.zip", "sub/page1.jpg")
+	symlink("../B/b.txt", "A/link-in")
+	symlink("../outside/secret.txt", "A/link-out")
+	symlink("../outside", "A/link-dir-out")
+	symlink("../outside/out.zip", "A/link-out.zip")
+	symlink("missing.txt", "A/dangling")
+	symlink("A", "L")
+
+	// EvalSymlinksの結果と比べるので、一時フォルダー自体のリンク（macOSの/varなど）はたどっておく
+	base, err := filepath.EvalSymlinks(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base, map[string]string{
+		"A":	filepath.Join(base, "A"),
+		"B":	filepath.Join(base, "B"),
+		"L":	filepath.Join(base, "L"),
+		"Z":	filepath.Join(base, "zipped.zip", "sub"),
+	}
+}
+
+func TestPathResolverResolve(t *testing.T) {
+	base, folders := resolverFixture(t)
+	sep := string(filepath.Separator)
+
+	tests := []struct {
+		name		string
+		policy		string		// symlinksの設定（空はallow-within-roots）
+		path		string		// URLのパス（%エンコードはハンドラーと同じく戻してから渡す）
+		ok			bool
+		kind		pathKind
+		fullPath	string		// baseからの相対パス。空のときは調べない
+		archive		string		// pathInArchiveのとき、baseからのアーカイブの相対パス
+		inner		string
+	}{
+		// ルートフォルダー
+		{name: "空", path: "", ok: false},
+		{name: "/だけ", path: "/", ok: false},
+		{name: "不明なルート", path: "X/file.txt", ok: false},
+		{name: "ルートフォルダー自体", path: "A", ok: true, kind: pathDir, fullPath: "A"},
+		{name: "先頭の/", path: "/A/file.txt", ok: true, kind: pathFile, fullPath: "A/file.txt"},
+
+		// ..で外に出る
+		{name: "..で外へ", path: "A/../../etc", ok: false},
+		{name: "..でルートの外へ", path: "A/../../outside/secret.txt", ok: false},
+		{name: "先頭の..", path: "../A/file.txt", ok: true, kind: pathFile, fullPath: "A/file.txt"},
+		{name: "..で別のルートへ", path: "A/../B/b.txt", ok: true, kind: pathFile, fullPath: "B/b.txt"},
+		{name: "エンコードした..", path: "A/%2e%2e/%2E%2E/etc", ok: false},
+		{name: "エンコードした/と..", path: "A%2f..%2f..%2foutside%2fsecret.txt", ok: false},
+		{name: "二重にエンコードした..", path: "A/%252e%252e/file.txt", ok: true, kind: pathMissing, fullPath: "A/%2e%2e/file.txt"},
+
+		// 区切り文字
+		{name: "/区切り", path: "A/sub/inner.txt", ok: true, kind: pathFile, fullPath: "A/sub/inner.txt"},
+		{name: "OSの区切り", path: "A" + sep + "sub" + sep + "inner.txt", ok: true, kind: pathFile, fullPath: "A/sub/inner.txt"},
+		{name: "末尾の区切り", path: "A/sub/", ok: true, kind: pathDir, fullPath: "A/sub"},
+		{name: "重なった区切り", path: "A//sub///inner.txt", ok: true, kind: pathFile, fullPath: "A/sub/inner.txt"},
+
+		// ファイル・フォルダー・存在しないもの
+		{name: "ファイル", path: "A/file.txt", ok: true, kind: pathFile, fullPath: "A/file.txt"},
+		{name: "フォルダー", path: "A/sub", ok: true, kind: pathDir, fullPath: "A/sub"},
+		{name: "存在しない", path: "A/nope.txt", ok: true, kind: pathMissing, fullPath: "A/nope.txt"},
+		{name: "存在しないフォルダーの中", path: "A/nope/x.txt", ok: true, kind: pathMissing, fullPath: "A/nope/x.txt"},
+
+		// アーカイブ
+		{name: "アーカイブ自体", path: "A/book.zip", ok: true, kind: pathFile, fullPath: "A/book.zip"},
+		{name: "アーカイブの中", path: "A/book.zip/ch1/page2.jpg", ok: true, kind: pathInArchive, archive: "A/book.zip", inner: "ch1/page2.jpg"},
+		{name: "アーカイブの中のフォルダー", path: "A/book.zip/ch1", ok: true, kind: pathInArchive, archive: "A/book.zip", inner: "ch1"},
+		{name: "アーカイブから..で外へ", path: "A/book.zip/../../outside/secret.txt", ok: false},
+		{name: "公開フォルダーの外のアーカイブ", policy: linkPolicyAllowAll, path: "Z/page1.jpg", ok: true, kind: pathMissing},
+		{name: "公開フォルダーの外のアーカイブ（既定）", path: "Z/page1.jpg", ok: false},
+
+		// シンボリックリンク: deny
+		{name: "deny: 別のルートへのリンク", policy: linkPolicyDeny, path: "A/link-in", ok: false},
+		{name: "deny: 外へのリンク", policy: linkPolicyDeny, path: "A/link-out", ok: false},
+		{name: "deny: 外のフォルダーの中", policy: linkPolicyDeny, path: "A/link-dir-out/secret.txt", ok: false},
+		{name: "deny: 外のアーカイブの中", policy: linkPolicyDeny, path: "A/link-out.zip/page1.jpg", ok: false},
+		{name: "deny: リンク先の無いリンク", policy: linkPolicyDeny, path: "A/dangling", ok: false},
+		{name: "deny: リンクの公開フォルダー", policy: linkPolicyDeny, path: "L/file.txt", ok: true, kind: pathFile, fullPath: "L/file.txt"},
+		{name: "deny: リンクの無いファイル", policy: linkPolicyDeny, path: "A/file.txt", ok: true, kind: pathFile, fullPath: "A/file.txt"},
+
+		// シンボリックリンク: allow-within-roots
+		{name: "within: 別のルートへのリンク", policy: linkPolicyWithinRoots, path: "A/link-in", ok: true, kind: pathFile, fullPath: "A/link-in"},
+		{name: "within: 外へのリンク", policy: linkPolicyWithinRoots, path: "A/link-out", ok: false},
+		{name: "within: 外のフォルダーの中", policy: linkPolicyWithinRoots, path: "A/link-dir-out/secret.txt", ok: false},
+		{name: "within: 外のアーカイブの中", policy: linkPolicyWithinRoots, path: "A/link-out.zip/page1.jpg", ok: false},
+		{name: "within: リンク先の無いリンク", policy: linkPolicyWithinRoots, path: "A/dangling", ok: true, kind: pathMissing, fullPath: "A/dangling"},
+		{name: "within: リンクの公開フォルダー", policy: linkPolicyWithinRoots, path: "L/sub/inner.txt", ok: true, kind: pathFile, fullPath: "L/sub/inner.txt"},
+		{name: "不明な値はwithin", policy: "unknown", path: "A/link-out", ok: false},
+
+		// シンボリックリンク: allow-all
+		{name: "all: 別のルートへのリンク", policy: linkPolicyAllowAll, path: "A/link-in", ok: true, kind: pathFile, fullPath: "A/link-in"},
+		{name: "all: 外へのリンク", policy: linkPolicyAllowAll, path: "A/link-out", ok: true, kind: pathFile, fullPath: "A/link-out"},
+		{name: "all: 外のフォルダーの中", policy: linkPolicyAllowAll, path: "A/link-dir-out/secret.txt", ok: true, kind: pathFile, fullPath: "A/link-dir-out/secret.txt"},
+		{name: "all: 外のアーカイブの中", policy: linkPolicyAllowAll, path: "A/link-out.zip/page1.jpg", ok: true, kind: pathInArchive, archive: "A/link-out.zip", inner: "page1.jpg"},
+		{name: "all: ..では外へ出られない", policy: linkPolicyAllowAll, path: "A/../../outside/secret.txt", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &ServerConfig{}
+			config.Config.Symlinks = tt.policy
+			virtualPath, err := url.PathUnescape(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			target, ok := newPathResolver(folders, config).resolve(virtualPath)
+			if ok != tt.ok {
+				t.Fatalf("resolve(%q) ok = %v, want %v", virtualPath, ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if target.kind != tt.kind {
+				t.Errorf("resolve(%q) kind = %v, want %v", virtualPath, target.kind, tt.kind)
+			}
+			if tt.fullPath != "" {
+				if want := filepath.Join(base, filepath.FromSlash(tt.fullPath)); target.fullPath != want {
+					t.Errorf("resolve(%q) fullPath = %q, want %q", virtualPath, target.fullPath, want)
+				}
+				// fullPathはbaseの直下のルートフォルダーからのパスなので、そのまま仮想パスになる
+				if got := target.virtualPath(); got != tt.fullPath {
+					t.Errorf("resolve(%q) virtualPath = %q, want %q", virtualPath, got, tt.fullPath)
+				}
+			}
+			if target.root != folders[target.rootName] || filepath.Join(target.root, filepath.FromSlash(target.rel)) != target.fullPath {
+				t.Errorf("resolve(%q) rootName = %q, root = %q, rel = %q, fullPath = %q", virtualPath, target.rootName, target.root, target.rel, target.fullPath)
+			}
+			if tt.kind == pathInArchive {
+				if want := filepath.Join(base, filepath.FromSlash(tt.archive)); target.archivePath != want {
+					t.Errorf("resolve(%q) archivePath = %q, want %q", virtualPath, target.archivePath, want)
+				}
+				if target.inner != tt.inner {
+					t.Errorf("resolve(%q) inner = %q, want %q", virtualPath, target.inner, tt.inner)
+				}
+			}
+			if (target.info != nil) != (tt.kind == pathFile || tt.kind == pathDir) {
+				t.Errorf("resolve(%q) info = %v, want info only for files and folders", virtualPath, target.info)
+			}
+		})
+	}
+}
+
+func TestPathResolverResolveFile(t *testing.T) {
+	base, folders := resolverFixture(t)
+	resolver := newPathResolver(folders, &ServerConfig{})
+
+	tests := []struct {
+		path	string
+		ok		bool
+	}{
+		{"A/file.txt", true},
+		{"A/link-in", true},
+		{"A/sub", false},
+		{"A/nope.txt", false},
+		{"A/book.zip/page1.jpg", false},
+		{"A/link-out", false},
+		{"A/../../outside/secret.txt", false},
+	}
+	for _, tt := range tests {
+		fullPath, info, ok := resolver.resolveFile(tt.path)
+		if ok != tt.ok {
+			t.Errorf("resolveFile(%q) ok = %v, want %v", tt.path, ok, tt.ok)
+			continue
+		}
+		if ok && (info == nil || fullPath != filepath.Join(base, filepath.FromSlash(tt.path))) {
+			t.Errorf("resolveFile(%q) = %q, %v", tt.path, fullPath, info)
+		}
+	}
+}
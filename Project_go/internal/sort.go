@@ -0,0 +1,201 @@
+// Functions/sort.go:並び順:Functions/sort.go
+//
+// フォルダーリストと画像ビューアで同じ並び順を使う
+// 並び順は設定ファイルのsortで決め、?sort=name|mtime|size|type&order=asc|desc&folders=first|mixedで上書きできる
+// 名前は数字を数値として比較する（page2 < page10）
+//
+
+package internal
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 並び順のキー
+const (
+	sortByName	= "name"
+	sortByMtime	= "mtime"
+	sortBySize	= "size"
+	sortByType	= "type"
+)
+
+// sortOptionsは並び順の指定を表します。
+type sortOptions struct {
+	Key				string
+	Desc			bool
+	FoldersFirst	bool
+}
+
+// sortItemは並べ替えに必要な項目の情報です。
+type sortItem struct {
+	name	string
+	isDir	bool
+	size	int64
+	modTime	time.Time
+}
+
+// getSortOptionsは設定ファイルとリクエストのクエリから並び順を決めます。
+func getSortOptions(r *http.Request, config *ServerConfig) sortOptions {
+	opts := sortOptions{
+		Key:			validSortKey(config.Config.Sort.Key),
+		Desc:			config.Config.Sort.Order == "desc",
+		FoldersFirst:	config.Config.Sort.FoldersFirst,
+	}
+
+	query := r.URL.Query()
+	if key := query.Get("sort"); key != "" {
+		opts.Key = validSortKey(key)
+	}
+	switch query.Get("order") {
+	case "asc":
+		opts.Desc = false
+	case "desc":
+		opts.Desc = true
+	}
+	switch query.Get("folders") {
+	case "first":
+		opts.FoldersFirst = true
+	case "mixed":
+		opts.FoldersFirst = false
+	}
+	return opts
+}
+
+// validSortKeyは知らないキーのときは名前順にします。
+func validSortKey(key string) string {
+	switch key {
+	case sortByMtime, sortBySize, sortByType:
+		return key
+	}
+	return sortByName
+}
+
+// listingQueryはフォルダーリストの表示に関するクエリだけを取り出します。
+// リンクに付けることで、下の階層や画像ビューアでも同じ表示と並び順が使われます。
+func listingQuery(r *http.Request) url.Values {
+	query := r.URL.Query()
+	kept := url.Values{}
+	for _, key := range []string{"view", "sort", "order", "folders"} {
+		if value := query.Get(key); value != "" {
+			kept.Set(key, value)
+		}
+	}
+	return kept
+}
+
+// QueryWithはフォルダーリストのクエリのうち、keyだけをvalueに変えたものを返します。
+// テンプレートから表示や並び順を切り替えるリンクを作るときに使います。
+func (d FolderData) QueryWith(key, value string) template.URL {
+	query := url.Values{}
+	for k, v := range d.query {
+		query[k] = v
+	}
+	query.Set(key, value)
+	return template.URL(query.Encode())
+}
+
+// sortEntriesはフォルダーリストの項目を並べ替えます。
+func sortEntries(entries []WS_FileEntry, opts sortOptions) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return opts.less(entries[i].sortItem(), entries[j].sortItem())
+	})
+}
+
+// sortItemはWS_FileEntryから並べ替えに必要な情報を取り出します。
+func (e WS_FileEntry) sortItem() sortItem {
+	return sortItem{name: e.WS_Name, isDir: e.WS_IsDirectory, size: e.size, modTime: e.modTime}
+}
+
+// lessは並び順に従ってaがbより前に来るかどうかを返します。
+func (opts sortOptions) less(a, b sortItem) bool {
+	if opts.FoldersFirst && a.isDir != b.isDir {
+		return a.isDir // 降順でもフォルダーは先頭
+	}
+
+	var cmp int
+	switch opts.Key {
+	case sortByMtime:
+		cmp = a.modTime.Compare(b.modTime)
+	case sortBySize:
+		cmp = compareInt64(a.size, b.size)
+	case sortByType:
+		cmp = naturalCompare(strings.TrimPrefix(filepath.Ext(a.name), "."), strings.TrimPrefix(filepath.Ext(b.name), "."))
+	}
+	if cmp == 0 {
+		cmp = naturalCompare(a.name, b.name)
+	}
+	if opts.Desc {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+// compareInt64はaとbを比較して-1、0、1を返します。
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// naturalCompareは数字の並びを数値として扱い、大文字小文字を区別せずに文字列を比較します。
+// 例えば"page2.jpg"は"page10.jpg"より前になります。
+func naturalCompare(a, b string) int {
+	ai, bi := 0, 0
+	for ai < len(a) && bi < len(b) {
+		ra, sizeA := utf8.DecodeRuneInString(a[ai:])
+		rb, sizeB := utf8.DecodeRuneInString(b[bi:])
+
+		if isASCIIDigit(ra) && isASCIIDigit(rb) {
+			// 数字の並びを取り出して数値として比較する
+			aj, bj := ai, bi
+			for aj < len(a) && isASCIIDigit(rune(a[aj])) {
+				aj++
+			}
+			for bj < len(b) && isASCIIDigit(rune(b[bj])) {
+				bj++
+			}
+			numA := strings.TrimLeft(a[ai:aj], "0")
+			numB := strings.TrimLeft(b[bi:bj], "0")
+			if len(numA) != len(numB) {
+				return compareInt64(int64(len(numA)), int64(len(numB)))
+			}
+			if c := strings.Compare(numA, numB); c != 0 {
+				return c
+			}
+			ai, bi = aj, bj
+			continue
+		}
+
+		la, lb := unicode.ToLower(ra), unicode.ToLower(rb)
+		if la != lb {
+			return compareInt64(int64(la), int64(lb))
+		}
+		ai += sizeA
+		bi += sizeB
+	}
+	switch {
+	case ai < len(a):
+		return 1
+	case bi < len(b):
+		return -1
+	}
+	// 同じに見える名前（大文字小文字や先頭の0の違い）は、元の文字列で順番を決める
+	return strings.Compare(a, b)
+}
+
+// isASCIIDigitは0から9の数字かどうかを返します。
+func isASCIIDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
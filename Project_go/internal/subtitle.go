@@ -0,0 +1,413 @@
+// Functions/subtitle.go:字幕:Functions/subtitle.go
+//
+// 動画と同じ名前の字幕ファイル（movie.srt、movie.ja.ass、movie.en.vttなど）と、
+// 動画に埋め込まれた字幕を見つけて、WebVTTに変換して送信する
+//	<字幕ファイル>.subtitle.vtt				字幕ファイルをWebVTTに変換する
+//	<動画ファイル>.subtitle.vtt?stream=番号	動画に埋め込まれた字幕をffmpegで取り出す
+// ?offset=秒を付けると、その分だけ時刻を前にずらす（?t=秒で途中から変換した動画に合わせるため）
+//
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
+)
+
+// 字幕ファイルの拡張子
+var subtitleExtensions = map[string]bool{".srt": true, ".vtt": true, ".ass": true, ".ssa": true}
+
+// テキストとして取り出せる埋め込み字幕のコーデック（PGSなどの画像の字幕は除く）
+var textSubtitleCodecs = map[string]bool{"subrip": true, "ass": true, "ssa": true, "webvtt": true, "mov_text": true, "text": true}
+
+// subtitleCueは字幕の1つの表示です。
+type subtitleCue struct {
+	start	time.Duration
+	end		time.Duration
+	text	string
+}
+
+// isSubtitleFileは字幕ファイルかどうかを返します。
+func isSubtitleFile(filePath string) bool {
+	return subtitleExtensions[strings.ToLower(filepath.Ext(filePath))]
+}
+
+// findSubtitlesは動画の字幕を探して、<track>に使う一覧を返します。
+// moviePathはURLのパス（先頭の/なし）、fullPathは動画ファイルのフルパスです。
+func findSubtitles(r *http.Request, moviePath string, fullPath string, info os.FileInfo, config *ServerConfig) []SubtitleTrack {
+	var tracks []SubtitleTrack
+
+	// 動画と同じ名前の字幕ファイル
+	dir := filepath.Dir(fullPath)
+	base := strings.TrimSuffix(filepath.Base(fullPath), filepath.Ext(fullPath))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Movie: フォルダの読み込みに失敗しました: '%s' %v", dir, err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !isSubtitleFile(name) || !strings.HasPrefix(name, base+".") {
+			continue
+		}
+		if ignored, _ := isIgnored(name, config.Ignores); ignored {
+			continue
+		}
+		// movie.ja.srtの"ja"を言語とみなす
+		middle := strings.TrimPrefix(strings.TrimSuffix(name, filepath.Ext(name)), base)
+		middle = strings.TrimPrefix(middle, ".")
+		lang, label := subtitleLanguage(middle)
+		if label == "" {
+			label = name
+		}
+		tracks = append(tracks, SubtitleTrack{
+			WS_Link:	"/" + path.Join(path.Dir(moviePath), name) + ".subtitle.vtt",
+			WS_Label:	label,
+			WS_Lang:	lang,
+		})
+	}
+
+	// 動画に埋め込まれた字幕
+	if probe, err := probeMovie(r.Context(), fullPath, info, config); err == nil {
+		for _, stream := range probe.Streams {
+			if stream.CodecType != "subtitle" || !textSubtitleCodecs[stream.CodecName] {
+				continue
+			}
+			lang, label := subtitleLanguage(stream.Tags["language"])
+			if title := stream.Tags["title"]; title != "" {
+				if label != "" {
+					label += " - "
+				}
+				label += title
+			}
+			if label == "" {
+				label = fmt.Sprintf("字幕 #%d", stream.Index)
+			}
+			tracks = append(tracks, SubtitleTrack{
+				WS_Link:	fmt.Sprintf("/%s.subtitle.vtt?stream=%d", moviePath, stream.Index),
+				WS_Label:	label,
+				WS_Lang:	lang,
+			})
+		}
+	}
+
+	// ブラウザーの言語と同じ字幕を最初から表示する
+	preferred, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	if len(preferred) > 0 {
+		want, _ := preferred[0].Base()
+		for i := range tracks {
+			if tag, err := language.Parse(tracks[i].WS_Lang); err == nil {
+				if have, _ := tag.Base(); have == want {
+					tracks[i].WS_Default = true
+					break
+				}
+			}
+		}
+	}
+	return tracks
+}
+
+// subtitleLanguageは"ja"や"jpn"のような言語の指定から、BCP 47の言語タグと表示名を返します。
+// 言語として解釈できないときは、空の言語タグと元の文字列を返します。
+func subtitleLanguage(value string) (string, string) {
+	if value == "" || value == "und" {
+		return "", ""
+	}
+	tag, err := language.Parse(value)
+	if err != nil {
+		return "", value
+	}
+	name := display.Self.Name(tag)
+	if name == "" {
+		name = value
+	}
+	return tag.String(), name
+}
+
+// HandleSubtitleRequestは字幕をWebVTTに変換して送信します。
+func HandleSubtitleRequest(resolvedFolders map[string]string, config *ServerConfig, err404Tmpl *template.Template) http.HandlerFunc {
+	paths := newPathResolver(resolvedFolders, config)
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestedPath := strings.TrimSuffix(getRequestedPath(r), ".subtitle.vtt")
+
+		// リクエストされたファイルパスを得る
+		fullPath, info, ok := paths.resolveFile(requestedPath)
+		if !ok || !(isSubtitleFile(fullPath) || IsMovieFile(fullPath)) {
+			log.Printf("Subtitle: 404: '%s'", requestedPath)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusNotFound)
+			err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
+			return
+		}
+
+		var data []byte
+		var err error
+		format := strings.ToLower(filepath.Ext(fullPath))
+		if IsMovieFile(fullPath) {
+			data, err = extractSubtitle(r, fullPath, info, config)
+			format = ".vtt"
+		} else {
+			data, err = os.ReadFile(fullPath)
+		}
+		if err != nil {
+			switch {
+			case errors.Is(err, os.ErrNotExist):
+				http.NotFound(w, r)
+			case errors.Is(err, errTranscodeBusy):
+				w.Header().Set("Retry-After", "10")
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+			default:
+				log.Printf("Subtitle: 字幕の読み込みに失敗しました: '%s' %v", fullPath, err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		var cues []subtitleCue
+		switch format {
+		case ".ass", ".ssa":
+			cues = parseASS(decodeSubtitleText(data))
+		default:
+			cues = parseSRT(decodeSubtitleText(data))
+		}
+
+		offset, _ := strconv.ParseFloat(r.URL.Query().Get("offset"), 64)
+		if math.IsNaN(offset) || offset < 0 {
+			offset = 0
+		}
+
+		log.Printf("Subtitle: 字幕の送信: '%s' (%d 個)", fullPath, len(cues))
+		w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache")
+		writeVTT(w, cues, time.Duration(offset*float64(time.Second)))
+	}
+}
+
+// extractSubtitleは動画に埋め込まれた字幕（?stream=番号）をffmpegでWebVTTとして取り出します。
+// 取り出した字幕はキャッシュに保存します。
+func extractSubtitle(r *http.Request, fullPath string, info os.FileInfo, config *ServerConfig) ([]byte, error) {
+	index, err := strconv.Atoi(r.URL.Query().Get("stream"))
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+	probe, err := probeMovie(r.Context(), fullPath, info, config)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, stream := range probe.Streams {
+		if stream.Index == index && stream.CodecType == "subtitle" && textSubtitleCodecs[stream.CodecName] {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, os.ErrNotExist
+	}
+
+	key := cacheKey(fullPath, info, fmt.Sprintf("subtitle:%d", index))
+	cachedPath, release, err := getImageCache(config).getOrCreate(r.Context(), key+".vtt", func(ctx context.Context, out io.Writer) error {
+		release, err := getToolLimiter(config).acquire(ctx, "subtitle", fullPath)
+		if err != nil {
+			return err
+		}
+		defer release()
+		log.Printf("Subtitle: 埋め込み字幕の取り出し: '%s' #%d", fullPath, index)
+		cmd := exec.CommandContext(ctx, "ffmpeg",
+			"-v", "error",
+			"-i", fullPath,
+			"-map", fmt.Sprintf("0:%d", index),
+			"-f", "webvtt",
+			"pipe:1")
+		cmd.Stdout = out
+		var stderr strings.Builder
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("ffmpegコマンド実行失敗: %w %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return os.ReadFile(cachedPath)
+}
+
+// decodeSubtitleTextは字幕ファイルの文字コードをUTF-8にそろえ、改行を\nにします。
+// BOMの付いたUTF-16と、UTF-8として正しくないもの（Shift_JISとみなす）を変換します。
+func decodeSubtitleText(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}), bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		if decoded, err := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewDecoder().Bytes(data); err == nil {
+			data = decoded
+		}
+	case !utf8.Valid(data):
+		if decoded, err := japanese.ShiftJIS.NewDecoder().Bytes(data); err == nil {
+			data = decoded
+		}
+	}
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.ReplaceAll(text, "\r", "\n")
+}
+
+// parseSRTはSRTとWebVTTの字幕を読み込みます。
+func parseSRT(text string) []subtitleCue {
+	var cues []subtitleCue
+	for _, block := range strings.Split(text, "\n\n") {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		for i, line := range lines {
+			if !strings.Contains(line, "-->") {
+				continue
+			}
+			// "00:00:01,000 --> 00:00:02,000 align:start" のような時刻の行
+			times := strings.SplitN(line, "-->", 2)
+			start, ok1 := parseSubtitleTime(times[0])
+			end, ok2 := parseSubtitleTime(strings.Fields(times[1] + " ")[0])
+			if ok1 && ok2 {
+				cues = append(cues, subtitleCue{start, end, strings.Join(lines[i+1:], "\n")})
+			}
+			break
+		}
+	}
+	return cues
+}
+
+// parseASSはASS/SSAの字幕の[Events]を読み込みます。装飾の指定は取り除きます。
+func parseASS(text string) []subtitleCue {
+	var cues []subtitleCue
+	inEvents := false
+	var format []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") {
+			inEvents = strings.EqualFold(line, "[Events]")
+			continue
+		}
+		if !inEvents {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "Format":
+			format = nil
+			for _, field := range strings.Split(value, ",") {
+				format = append(format, strings.TrimSpace(field))
+			}
+		case "Dialogue":
+			if len(format) == 0 {
+				continue
+			}
+			// 最後の項目（Text）にはカンマが含まれることがある
+			fields := strings.SplitN(strings.TrimSpace(value), ",", len(format))
+			if len(fields) != len(format) {
+				continue
+			}
+			var cue subtitleCue
+			var ok1, ok2 bool
+			for i, name := range format {
+				switch name {
+				case "Start":
+					cue.start, ok1 = parseSubtitleTime(fields[i])
+				case "End":
+					cue.end, ok2 = parseSubtitleTime(fields[i])
+				case "Text":
+					cue.text = assText(fields[i])
+				}
+			}
+			if ok1 && ok2 && cue.text != "" {
+				cues = append(cues, cue)
+			}
+		}
+	}
+	sort.SliceStable(cues, func(i, j int) bool {
+		return cues[i].start < cues[j].start
+	})
+	return cues
+}
+
+// assTextはASSの台詞から装飾の指定を取り除き、WebVTTのテキストにします。
+func assText(text string) string {
+	var b strings.Builder
+	for {
+		open := strings.Index(text, "{")
+		if open < 0 {
+			break
+		}
+		close := strings.Index(text[open:], "}")
+		if close < 0 {
+			break
+		}
+		b.WriteString(text[:open])
+		text = text[open+close+1:]
+	}
+	b.WriteString(text)
+	replacer := strings.NewReplacer(`\N`, "\n", `\n`, "\n", `\h`, " ", "&", "&amp;", "<", "&lt;", ">", "&gt;")
+	return strings.TrimSpace(replacer.Replace(b.String()))
+}
+
+// parseSubtitleTimeは"01:02:03,456"、"02:03.456"、"1:02:03.45"のような時刻を読み込みます。
+func parseSubtitleTime(value string) (time.Duration, bool) {
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, false
+	}
+	var seconds float64
+	for i, part := range parts {
+		if i == len(parts)-1 {
+			part = strings.Replace(part, ",", ".", 1)
+		}
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		seconds = seconds*60 + n
+	}
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+// writeVTTは字幕をWebVTTで書き出します。offsetの分だけ時刻を前にずらし、それより前に終わる字幕は除きます。
+func writeVTT(w io.Writer, cues []subtitleCue, offset time.Duration) {
+	io.WriteString(w, "WEBVTT\n\n")
+	for _, cue := range cues {
+		start, end := cue.start-offset, cue.end-offset
+		if end <= 0 {
+			continue
+		}
+		start = max(start, 0)
+		// 空行があると字幕の区切りになってしまうので詰める
+		text := strings.ReplaceAll(strings.Trim(cue.text, "\n"), "\n\n", "\n")
+		text = strings.ReplaceAll(text, "-->", "->")
+		fmt.Fprintf(w, "%s --> %s\n%s\n\n", formatVTTTime(start), formatVTTTime(end), text)
+	}
+}
+
+// formatVTTTimeは時刻を"00:01:02.345"の形式にします。
+func formatVTTTime(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,187 @@
+// Functions/thumbnail.go:サムネイルハンドラ:Functions/thumbnail.go
+//
+// フォルダーのグリッド表示で使うサムネイルを返す
+// 画像は縮小処理、動画はffmpegで途中のキーフレーム、音声はカバー画像、PDFはpdftoppmで1ページ目から作成する
+// 作成したサムネイルは縮小画像と同じキャッシュに保存される
+//
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// サムネイルの大きさに関する値
+const (
+	defaultThumbnailSize	= 256
+	minThumbnailSize		= 32
+	maxThumbnailSize		= 1024
+)
+
+// HandleThumbnailRequestは`.thumb`リクエストを処理してサムネイル画像を返します。
+func HandleThumbnailRequest(resolvedFolders map[string]string, config *ServerConfig, err404Tmpl *template.Template) http.HandlerFunc {
+	paths := newPathResolver(resolvedFolders, config)
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestedPath := getRequestedPath(r)
+
+		// .thumbを取り除いて元のファイルパスを取得
+		originalPath := strings.TrimSuffix(requestedPath, ".thumb")
+
+		if fullPath, info, ok := paths.resolveFile(originalPath); ok && hasThumbnail(fullPath) {
+			size := thumbnailSize(r, config)
+			cachedFile, key, release, err := createThumbnail(r.Context(), fullPath, info, size, config)
+			if err != nil {
+				log.Printf("Thumbnail: サムネイルの作成に失敗しました: '%s' %v", fullPath, err)
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.WriteHeader(http.StatusInternalServerError)
+				err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
+				return
+			}
+			serveCachedFile(w, r, cachedFile, key, info.ModTime())
+			release()
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		err404Tmpl.Execute(w, NotFoundData{WS_Link: r.URL.Path})
+	}
+}
+
+// hasThumbnailはサムネイルを作成できるファイルかどうかを返します。
+func hasThumbnail(path string) bool {
+	return isImageFile(path) || IsMovieFile(path) || IsAudioFile(path) || isPDFFile(path)
+}
+
+// isPDFFileはファイルがPDFであるかどうかをチェックします。
+func isPDFFile(path string) bool {
+	return strings.ToLower(filepath.Ext(path)) == ".pdf"
+}
+
+// thumbnailSizeはリクエストの?size=から、サムネイルの大きさを決めます。
+func thumbnailSize(r *http.Request, config *ServerConfig) int {
+	size := config.Config.Image.ThumbnailSize
+	if size <= 0 {
+		size = defaultThumbnailSize
+	}
+	if value, err := strconv.Atoi(r.URL.Query().Get("size")); err == nil {
+		size = value
+	}
+	return min(max(size, minThumbnailSize), maxThumbnailSize)
+}
+
+// thumbnailURLはフォルダーリストから参照するサムネイルの相対URLを返します。
+func thumbnailURL(entryName string, config *ServerConfig) template.URL {
+	size := config.Config.Image.ThumbnailSize
+	if size <= 0 {
+		size = defaultThumbnailSize
+	}
+	return template.URL(fmt.Sprintf("%s.thumb?size=%d", url.PathEscape(entryName), size))
+}
+
+// createThumbnailはファイルの種類に応じてサムネイルを作成し、キャッシュファイルのパスとキー、送信し終わったときに呼ぶ関数を返します。
+func createThumbnail(ctx context.Context, fullPath string, info os.FileInfo, size int, config *ServerConfig) (string, string, func(), error) {
+	if isImageFile(fullPath) {
+		return imageResize(ctx, fullPath, info, size, config)
+	}
+
+	// 音声ファイルは埋め込まれたカバー画像、無いときはフォルダーのカバー画像を使う
+	if IsAudioFile(fullPath) {
+		probe, err := probeMovie(ctx, fullPath, info, config)
+		if err == nil {
+			_, hasCover := probe.coverStream()
+			if !hasCover {
+				coverName, ok := findFolderCover(filepath.Dir(fullPath), config)
+				if !ok {
+					return "", "", nil, fmt.Errorf("カバー画像がありません")
+				}
+				coverPath := filepath.Join(filepath.Dir(fullPath), coverName)
+				coverInfo, err := os.Stat(coverPath)
+				if err != nil {
+					return "", "", nil, err
+				}
+				return imageResize(ctx, coverPath, coverInfo, size, config)
+			}
+		}
+	}
+
+	key := cacheKey(fullPath, info, fmt.Sprintf("thumb:%d:v2", size))
+	cachedPath, release, err := getImageCache(config).getOrCreate(ctx, key+".jpg", func(ctx context.Context, w io.Writer) error {
+		log.Printf("Thumbnail: サムネイルの作成: '%s' (%d)", fullPath, size)
+		if IsMovieFile(fullPath) {
+			return movieThumbnail(ctx, w, fullPath, info, size, config)
+		}
+		if IsAudioFile(fullPath) {
+			return audioThumbnail(ctx, w, fullPath, size, config)
+		}
+		return pdfThumbnail(ctx, w, fullPath, size, config)
+	})
+	if err != nil {
+		return "", "", nil, err
+	}
+	return cachedPath, key, release, nil
+}
+
+// movieThumbnailはffmpegで動画のキーフレームを取り出し、JPEGで書き出します。
+// 最初のフレームは黒いことが多いので、長さが分かるときは少し進めた位置（全体の10%、最大60秒）から取り出します。
+func movieThumbnail(ctx context.Context, w io.Writer, filePath string, info os.FileInfo, size int, config *ServerConfig) error {
+	scale := fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease", size, size)
+	args := []string{"-v", "error"}
+	if duration, err := movieDuration(ctx, filePath, info, config); err == nil {
+		args = append(args, "-ss", strconv.FormatFloat(min(duration/10, 60), 'f', 3, 64))
+	}
+	args = append(args,
+		"-skip_frame", "nokey",
+		"-i", filePath,
+		"-frames:v", "1",
+		"-vf", scale,
+		"-f", "image2",
+		"-c:v", "mjpeg",
+		"pipe:1")
+	return runThumbnailCommand(ctx, w, filePath, config, "ffmpeg", args...)
+}
+
+// pdfThumbnailはpdftoppmでPDFの1ページ目を画像にし、JPEGで書き出します。
+func pdfThumbnail(ctx context.Context, w io.Writer, filePath string, size int, config *ServerConfig) error {
+	return runThumbnailCommand(ctx, w, filePath, config, "pdftoppm",
+		"-jpeg",
+		"-f", "1", "-l", "1",
+		"-scale-to", strconv.Itoa(size),
+		"-singlefile",
+		filePath)
+}
+
+// runThumbnailCommandは外部コマンドを実行し、標準出力をwに書き出します。
+// 短い処理の同時実行数の制限（transcode.goのgetToolLimiter）の中で実行し、ctxがキャンセルされたら終了させます。
+func runThumbnailCommand(ctx context.Context, w io.Writer, filePath string, config *ServerConfig, name string, args ...string) error {
+	release, err := getToolLimiter(config).acquire(ctx, "thumbnail", filePath)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%sコマンド実行失敗: %w %s", filepath.Base(cmd.Path), err, strings.TrimSpace(stderr.String()))
+	}
+	if out.Len() == 0 {
+		return fmt.Errorf("%sコマンドの出力が空です", filepath.Base(cmd.Path))
+	}
+	_, err = w.Write(out.Bytes())
+	return err
+}
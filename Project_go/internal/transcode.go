@@ -0,0 +1,148 @@
+// Functions/transcode.go:ffmpegの同時実行数の管理:Functions/transcode.go
+//
+// 動画の変換は重いので、同時に動かすffmpegの数に上限を設ける
+// 上限に達しているときは空くまで待ち、待ち時間を超えたら503を返す
+// ffprobe・サムネイル・字幕の取り出しのような短い処理は、再生中の変換の後ろに並ばないように別の上限で数える
+//
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// 同時変換数のデフォルト値
+const (
+	defaultTranscodeMaxJobs			= 2
+	defaultTranscodeQueueTimeout	= 30	// 秒
+	defaultToolMaxJobs				= 4
+	toolQueueTimeout				= 10	// 秒。短い処理は長く待たせず、情報やサムネイル無しで表示する
+)
+
+// errTranscodeBusyは変換の順番待ちがタイムアウトしたときのエラーです。
+var errTranscodeBusy = errors.New("同時に変換できる数の上限に達しています")
+
+// transcodeJobは実行中の1つの変換です。
+type transcodeJob struct {
+	id		int64
+	kind	string	// "stream"、"hls"など
+	path	string
+	started	time.Time
+}
+
+// transcodeLimiterは変換の同時実行数を制限します。
+type transcodeLimiter struct {
+	name			string	// ログに表示する名前
+	slots			chan struct{}
+	queueTimeout	time.Duration
+
+	mu		sync.Mutex
+	nextID	int64
+	jobs	map[int64]*transcodeJob
+	waiting	int
+}
+
+var (
+	transcodeLimiterOnce	sync.Once
+	transcodeLimiterInst	*transcodeLimiter
+	toolLimiterOnce			sync.Once
+	toolLimiterInst			*transcodeLimiter
+)
+
+// getTranscodeLimiterは設定ファイルに従って、変換の同時実行数の制限を返します。
+func getTranscodeLimiter(config *ServerConfig) *transcodeLimiter {
+	transcodeLimiterOnce.Do(func() {
+		maxJobs := config.Config.Transcode.MaxJobs
+		if maxJobs <= 0 {
+			maxJobs = defaultTranscodeMaxJobs
+		}
+		timeout := config.Config.Transcode.QueueTimeout
+		if timeout <= 0 {
+			timeout = defaultTranscodeQueueTimeout
+		}
+		transcodeLimiterInst = newTranscodeLimiter("Transcode", maxJobs, timeout)
+	})
+	return transcodeLimiterInst
+}
+
+// getToolLimiterは、ffprobe・サムネイル・字幕の取り出しのような短い処理の同時実行数の制限を返します。
+// 再生中の変換とは別に数えるので、長い変換で上限に達していても待たされません。
+func getToolLimiter(config *ServerConfig) *transcodeLimiter {
+	toolLimiterOnce.Do(func() {
+		maxJobs := config.Config.Transcode.MaxToolJobs
+		if maxJobs <= 0 {
+			maxJobs = defaultToolMaxJobs
+		}
+		toolLimiterInst = newTranscodeLimiter("Probe", maxJobs, toolQueueTimeout)
+	})
+	return toolLimiterInst
+}
+
+// newTranscodeLimiterは同時実行数がmaxJobs、待ち時間の上限がtimeout秒のtranscodeLimiterを作ります。
+func newTranscodeLimiter(name string, maxJobs int, timeout int) *transcodeLimiter {
+	return &transcodeLimiter{
+		name:			name,
+		slots:			make(chan struct{}, maxJobs),
+		queueTimeout:	time.Duration(timeout) * time.Second,
+		jobs:			make(map[int64]*transcodeJob),
+	}
+}
+
+// acquireは変換を始められるまで待ちます。
+// 成功したときは、変換が終わったら必ず呼ぶ関数を返します。
+// ctxがキャンセルされたときはctx.Err()を、待ち時間を超えたときはerrTranscodeBusyを返します。
+func (l *transcodeLimiter) acquire(ctx context.Context, kind string, path string) (func(), error) {
+	l.mu.Lock()
+	l.waiting++
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case l.slots <- struct{}{}:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+		err = errTranscodeBusy
+	}
+
+	l.mu.Lock()
+	l.waiting--
+	if err != nil {
+		l.mu.Unlock()
+		log.Printf("%s: 開始できません: '%s' (%s) %v", l.name, path, kind, err)
+		return nil, err
+	}
+	l.nextID++
+	job := &transcodeJob{id: l.nextID, kind: kind, path: path, started: time.Now()}
+	l.jobs[job.id] = job
+	l.logJobsLocked("開始", job)
+	l.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			delete(l.jobs, job.id)
+			l.logJobsLocked("終了", job)
+			l.mu.Unlock()
+			<-l.slots
+		})
+	}, nil
+}
+
+// logJobsLockedは実行中の変換の一覧をログに出します。
+// 呼び出し側でl.muをロックしておくこと。
+func (l *transcodeLimiter) logJobsLocked(event string, job *transcodeJob) {
+	log.Printf("%s: #%d %s: '%s' (%s, %s) 実行中 %d/%d, 待ち %d",
+		l.name, job.id, event, job.path, job.kind, time.Since(job.started).Round(time.Second), len(l.jobs), cap(l.slots), l.waiting)
+	for _, j := range l.jobs {
+		log.Printf("%s:   #%d '%s' (%s, %s)", l.name, j.id, j.path, j.kind, time.Since(j.started).Round(time.Second))
+	}
+}
@@ -0,0 +1,261 @@
+// Functions/transcodecache.go:変換済み動画のキャッシュ:Functions/transcodecache.go
+//
+// 変換が必要な動画は、一度最後まで変換したMP4を作業用フォルダーのtranscode/に保存する
+// 保存済みの動画は普通のファイルとして送信するので、Rangeリクエストでシークできる
+// 変換はpretranscodeが有効なときだけ、バックグラウンドで1つずつ行う。フォルダーを調べて見つけたときと、再生されたときに行う
+//
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 変換済み動画のデフォルト値
+const (
+	defaultTranscodeCacheSize	= 10240	// MB
+	defaultPretranscodeInterval	= 60	// 分
+)
+
+var (
+	transcodeCacheOnce	sync.Once
+	transcodeCache		*diskCache
+)
+
+// getTranscodeCacheは変換済み動画用のキャッシュを返します。
+func getTranscodeCache(config *ServerConfig) *diskCache {
+	transcodeCacheOnce.Do(func() {
+		maxSize := config.Config.Transcode.CacheSize
+		if maxSize <= 0 {
+			maxSize = defaultTranscodeCacheSize
+		}
+		transcodeCache = newDiskCache(filepath.Join(config.Config.Temporary, "transcode"), maxSize*1024*1024)
+	})
+	return transcodeCache
+}
+
+// cachedTranscodePlanはキャッシュに保存するときの変換方法を返します。保存するのは設定ファイルのプロファイルだけです。
+func cachedTranscodePlan(ctx context.Context, fullPath string, info os.FileInfo, config *ServerConfig) transcodePlan {
+	profileName, profile := transcodeProfile(nil, config)
+	return planTranscode(ctx, fullPath, info, profileName, profile, config)
+}
+
+// transcodeCacheNameは動画と変換方法に対応するキャッシュのファイル名を返します。
+func transcodeCacheName(fullPath string, info os.FileInfo, plan transcodePlan) string {
+	return cacheKey(fullPath, info, plan.variant()) + ".mp4"
+}
+
+// cachedTranscodeは変換済みの動画があれば、そのパスと送信し終わったときに呼ぶ関数を返します。
+func cachedTranscode(ctx context.Context, fullPath string, info os.FileInfo, config *ServerConfig) (string, func(), bool) {
+	plan := cachedTranscodePlan(ctx, fullPath, info, config)
+	return getTranscodeCache(config).get(transcodeCacheName(fullPath, info, plan))
+}
+
+// transcodeQueueはバックグラウンドで変換する動画の順番待ちです。
+type transcodeQueue struct {
+	ctx		context.Context	// キャンセルされたら変換を止めて終了する
+	ch		chan string
+	mu		sync.Mutex
+	queued	map[string]bool		// 順番待ち・変換中のパス
+	failed	map[string]time.Time	// 変換に失敗したパスと、そのときの更新日時
+}
+
+// バックグラウンドの変換の順番待ち。pretranscodeが有効なときだけ、サーバーの起動時にStartPretranscodeが作る
+var transcodeQueueInst *transcodeQueue
+
+// enqueueTranscodeは動画をバックグラウンドの変換の順番待ちに加えます。
+// pretranscodeが無効なとき、変換済み・順番待ち中・前回失敗したままのときは何もしません。
+func enqueueTranscode(ctx context.Context, fullPath string, info os.FileInfo, config *ServerConfig) {
+	q := transcodeQueueInst
+	if q == nil {
+		return
+	}
+	if _, release, ok := cachedTranscode(ctx, fullPath, info, config); ok {
+		release()
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.queued[fullPath] {
+		return
+	}
+	if modTime, ok := q.failed[fullPath]; ok && modTime.Equal(info.ModTime()) {
+		return
+	}
+	select {
+	case q.ch <- fullPath:
+		q.queued[fullPath] = true
+		log.Printf("Transcode: 変換の順番待ちに追加: '%s'", fullPath)
+	default:
+		log.Printf("Transcode: 順番待ちがいっぱいのため追加できません: '%s'", fullPath)
+	}
+}
+
+// runは順番待ちの動画を1つずつ変換します。q.ctxがキャンセルされたら終了します。
+func (q *transcodeQueue) run(config *ServerConfig) {
+	for {
+		var fullPath string
+		select {
+		case fullPath = <-q.ch:
+		case <-q.ctx.Done():
+			log.Printf("Transcode: バックグラウンドの変換を終了します")
+			return
+		}
+		info, err := os.Stat(fullPath)
+		if err == nil {
+			err = q.transcode(fullPath, info, config)
+		}
+		q.mu.Lock()
+		delete(q.queued, fullPath)
+		if err != nil {
+			log.Printf("Transcode: 変換に失敗しました: '%s' %v", fullPath, err)
+			if info != nil {
+				q.failed[fullPath] = info.ModTime()
+			}
+		} else {
+			delete(q.failed, fullPath)
+		}
+		q.mu.Unlock()
+	}
+}
+
+// transcodeは1つの動画を変換して、キャッシュに保存します。
+func (q *transcodeQueue) transcode(fullPath string, info os.FileInfo, config *ServerConfig) error {
+	plan := cachedTranscodePlan(q.ctx, fullPath, info, config)
+	_, release, err := getTranscodeCache(config).getOrCreateFile(q.ctx, transcodeCacheName(fullPath, info, plan), func(ctx context.Context, tmp *os.File) error {
+		// 再生中の変換を優先したいので、空きが出るまで待ち続ける
+		var release func()
+		for {
+			var err error
+			release, err = getTranscodeLimiter(config).acquire(ctx, "cache", fullPath)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, errTranscodeBusy) {
+				return err
+			}
+		}
+		defer release()
+
+		log.Printf("Transcode: 変換開始: '%s' (%s)", fullPath, plan)
+		started := time.Now()
+		if err := transcodeToFile(ctx, fullPath, tmp.Name(), plan); err != nil {
+			return err
+		}
+		log.Printf("Transcode: 変換完了: '%s' (%s)", fullPath, time.Since(started).Round(time.Second))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	release()
+	return nil
+}
+
+// transcodeToFileは動画をシークできるMP4に変換して、outputPathに書き出します。
+// moovを先頭に移すため、パイプではなくファイルに書き出します。
+func transcodeToFile(ctx context.Context, inputPath string, outputPath string, plan transcodePlan) error {
+	args := []string{"-v", "error", "-y", "-i", inputPath}
+	args = append(args, plan.codecArgs()...)
+	args = append(args,
+		"-movflags", "+faststart",
+		"-f", "mp4",
+		outputPath)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpegコマンド実行失敗: %w %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// StartPretranscodeは設定ファイルのpretranscodeが有効なとき、
+// 定期的にフォルダーを調べて、変換が必要な動画を前もって変換するゴルーチンを起動します。
+// 再生された動画も、このときだけ変換の順番待ちに加えます。ctxがキャンセルされたら変換を止めて終了します。
+func StartPretranscode(ctx context.Context, resolvedFolders map[string]string, config *ServerConfig) {
+	settings := config.Config.Transcode.Pretranscode
+	if !settings.Enabled {
+		return
+	}
+	interval := settings.Interval
+	if interval <= 0 {
+		interval = defaultPretranscodeInterval
+	}
+
+	// 対象のフォルダー（指定が無いときは全て）
+	roots := make(map[string]string)
+	if len(settings.Folders) == 0 {
+		roots = resolvedFolders
+	}
+	for _, name := range settings.Folders {
+		if resolvedPath, ok := resolvedFolders[name]; ok {
+			roots[name] = resolvedPath
+		} else {
+			log.Printf("Transcode: pretranscodeのフォルダーが見つかりません: '%s'", name)
+		}
+	}
+
+	transcodeQueueInst = &transcodeQueue{
+		ctx:	ctx,
+		ch:		make(chan string, 1024),
+		queued:	make(map[string]bool),
+		failed:	make(map[string]time.Time),
+	}
+	go transcodeQueueInst.run(config)
+
+	log.Printf("Transcode: 前もって変換する動画を%d分ごとに探します (%d フォルダー)", interval, len(roots))
+	go func() {
+		for {
+			for name, root := range roots {
+				scanPretranscode(ctx, name, root, config)
+			}
+			select {
+			case <-time.After(time.Duration(interval) * time.Minute):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// scanPretranscodeはフォルダー以下の変換が必要な動画を、変換の順番待ちに加えます。
+func scanPretranscode(ctx context.Context, name string, root string, config *ServerConfig) {
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			log.Printf("Transcode: フォルダーの読み込みに失敗しました: '%s' %v", path, err)
+			return nil
+		}
+		if ignored, _ := isIgnored(d.Name(), config.Ignores); ignored && path != root {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !IsMovieFile(path) || !needsTranscode(path) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		enqueueTranscode(ctx, path, info, config)
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		log.Printf("Transcode: '%s' を調べられませんでした: %v", name, err)
+	}
+}
@@ -0,0 +1,164 @@
+// Functions/transcodeprofile.go:動画の変換方法の決定:Functions/transcodeprofile.go
+//
+// ffprobeでコーデックを調べ、ブラウザーで再生できるストリームはそのままコピーし（リマックス）、
+// 再生できないストリームだけを変換する
+// 変換するときの設定（コーデック・CRF・プリセット・最大の大きさ）は、設定ファイルのプロファイルで指定する
+//
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// プロファイルが無いときに使う値
+var (
+	defaultTranscodeCRF		= 23
+	defaultTranscodeProfile	= TranscodeProfile{
+		VideoCodec:		"libx264",
+		CRF:			&defaultTranscodeCRF,
+		Preset:			"veryfast",
+		MaxHeight:		0,
+		AudioCodec:		"aac",
+		AudioBitrate:	160,
+	}
+)
+
+// ブラウザーがMP4の中でそのまま再生できるコーデック
+var (
+	browserVideoCodecs = map[string]bool{"h264": true}
+	browserAudioCodecs = map[string]bool{"aac": true, "mp3": true}
+)
+
+// transcodePlanは1つの動画をどう変換するかを表します。
+type transcodePlan struct {
+	profileName	string
+	profile		TranscodeProfile
+	copyVideo	bool	// 映像をそのままコピーする
+	copyAudio	bool	// 音声をそのままコピーする
+	hasAudio	bool
+}
+
+// transcodeProfileはリクエスト（?profile=名前）と設定ファイルから、使うプロファイルを返します。
+func transcodeProfile(r *http.Request, config *ServerConfig) (string, TranscodeProfile) {
+	name := config.Config.Transcode.Profile
+	if r != nil {
+		if requested := r.URL.Query().Get("profile"); requested != "" {
+			if _, ok := config.Config.Transcode.Profiles[requested]; ok {
+				name = requested
+			}
+		}
+	}
+	profile, ok := config.Config.Transcode.Profiles[name]
+	if !ok {
+		return "default", defaultTranscodeProfile
+	}
+
+	// 指定されていない項目はデフォルト値を使う
+	if profile.VideoCodec == "" {
+		profile.VideoCodec = defaultTranscodeProfile.VideoCodec
+	}
+	if profile.CRF == nil {
+		profile.CRF = defaultTranscodeProfile.CRF
+	}
+	if profile.Preset == "" {
+		profile.Preset = defaultTranscodeProfile.Preset
+	}
+	if profile.AudioCodec == "" {
+		profile.AudioCodec = defaultTranscodeProfile.AudioCodec
+	}
+	if profile.AudioBitrate <= 0 {
+		profile.AudioBitrate = defaultTranscodeProfile.AudioBitrate
+	}
+	return name, profile
+}
+
+// planTranscodeは動画のコーデックを調べて、変換方法を決めます。
+// ffprobeが使えないときは、映像も音声も変換します。
+func planTranscode(ctx context.Context, filePath string, info os.FileInfo, profileName string, profile TranscodeProfile, config *ServerConfig) transcodePlan {
+	plan := transcodePlan{profileName: profileName, profile: profile, hasAudio: true}
+	if info == nil {
+		return plan
+	}
+	probe, err := probeMovie(ctx, filePath, info, config)
+	if err != nil {
+		log.Printf("Transcode: 動画の情報取得に失敗したため、全て変換します: '%s' %v", filePath, err)
+		return plan
+	}
+
+	if video, ok := probe.videoStream(); ok {
+		plan.copyVideo = isBrowserVideo(video) && (profile.MaxHeight <= 0 || video.Height <= profile.MaxHeight)
+	}
+	audio, ok := probe.audioStream()
+	plan.hasAudio = ok
+	plan.copyAudio = ok && browserAudioCodecs[audio.CodecName]
+	return plan
+}
+
+// isBrowserVideoはブラウザーでそのまま再生できる映像かどうかを返します。
+// H.264でも10bitや4:2:2は再生できないブラウザーが多いので変換します。
+func isBrowserVideo(stream probeStream) bool {
+	if !browserVideoCodecs[stream.CodecName] {
+		return false
+	}
+	if stream.PixFmt != "" && stream.PixFmt != "yuv420p" && stream.PixFmt != "yuvj420p" {
+		return false
+	}
+	return !strings.Contains(stream.Profile, "10") && !strings.Contains(stream.Profile, "4:2:2") && !strings.Contains(stream.Profile, "4:4:4")
+}
+
+// codecArgsはffmpegに渡す、ストリームの選択とコーデックの引数を返します。
+func (p transcodePlan) codecArgs() []string {
+	args := []string{"-map", "0:v:0"}
+	if p.copyVideo {
+		args = append(args, "-c:v", "copy")
+	} else {
+		args = append(args,
+			"-c:v", p.profile.VideoCodec,
+			"-preset", p.profile.Preset,
+			"-crf", strconv.Itoa(*p.profile.CRF),
+			"-pix_fmt", "yuv420p")
+		if p.profile.MaxHeight > 0 {
+			args = append(args, "-vf", fmt.Sprintf("scale=-2:'min(%d,ih)'", p.profile.MaxHeight))
+		}
+	}
+	if p.hasAudio {
+		args = append(args, "-map", "0:a:0?")
+		if p.copyAudio {
+			args = append(args, "-c:a", "copy")
+		} else {
+			args = append(args,
+				"-c:a", p.profile.AudioCodec,
+				"-b:a", fmt.Sprintf("%dk", p.profile.AudioBitrate),
+				"-ac", "2")
+		}
+	}
+	return args
+}
+
+// variantはキャッシュのキーに使う、変換方法を表す文字列を返します。
+func (p transcodePlan) variant() string {
+	return fmt.Sprintf("mp4:%s:%s:%d:%s:%d:%s:%d:%t:%t",
+		p.profileName, p.profile.VideoCodec, *p.profile.CRF, p.profile.Preset, p.profile.MaxHeight,
+		p.profile.AudioCodec, p.profile.AudioBitrate, p.copyVideo, p.copyAudio)
+}
+
+// Stringはログに出すための説明を返します。
+func (p transcodePlan) String() string {
+	video, audio := "変換", "変換"
+	if p.copyVideo {
+		video = "コピー"
+	}
+	if p.copyAudio {
+		audio = "コピー"
+	} else if !p.hasAudio {
+		audio = "なし"
+	}
+	return fmt.Sprintf("%s 映像:%s 音声:%s", p.profileName, video, audio)
+}
@@ -0,0 +1,159 @@
+// Functions/viewerstore.go:閲覧者ごとの保存先:Functions/viewerstore.go
+//
+// 再生位置（progress.go）や画像ビューアのしおり（bookmark.go）のように、
+// 閲覧者（ブラウザーのクッキー）ごとの値を、仮想パスをキーにして作業用フォルダーのJSONファイルに保存する
+// 閲覧者ごとに決まった数まで保存し、超えたら古いものから消す。書き込みは少し待ってからまとめて行う
+//
+
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// viewerEntryはviewerStoreに保存できる値です。古いものから消すために、更新日時を返します。
+type viewerEntry interface {
+	updatedAt() time.Time
+}
+
+// viewerStoreは閲覧者ごとの値を、仮想パスをキーにして保存します。
+type viewerStore[T viewerEntry] struct {
+	mu			sync.Mutex
+	name		string				// ログに表示する名前
+	path		string
+	maxEntries	int					// 閲覧者ごとに保存する数
+	saveDelay	time.Duration		// 書き込みをまとめる間隔
+	viewers		map[string]map[string]T
+	saveTimer	*time.Timer
+}
+
+// newViewerStoreはファイルから読み込んだ保存先を返します。ファイルが無いときは空で始めます。
+func newViewerStore[T viewerEntry](name string, filePath string, maxEntries int, saveDelay time.Duration) *viewerStore[T] {
+	s := &viewerStore[T]{
+		name:		name,
+		path:		filePath,
+		maxEntries:	maxEntries,
+		saveDelay:	saveDelay,
+		viewers:	make(map[string]map[string]T),
+	}
+	content, err := os.ReadFile(s.path)
+	if err == nil {
+		err = json.Unmarshal(content, &s.viewers)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("%s: 読み込めません: '%s' %v", s.name, s.path, err)
+	}
+	return s
+}
+
+// getは保存されている値を返します。
+func (s *viewerStore[T]) get(viewer string, key string) (T, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.viewers[viewer][key]
+	return entry, ok
+}
+
+// setは値を保存します。updateには保存されている値（無ければゼロ値とfalse）が渡されるので、新しい値を返してください。
+func (s *viewerStore[T]) set(viewer string, key string, update func(prev T, ok bool) T) T {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, ok := s.viewers[viewer]
+	if !ok {
+		entries = make(map[string]T)
+		s.viewers[viewer] = entries
+	}
+	prev, ok := entries[key]
+	entry := update(prev, ok)
+	entries[key] = entry
+
+	// 古いものから消す
+	for len(entries) > s.maxEntries {
+		var oldest string
+		for k, e := range entries {
+			if oldest == "" || e.updatedAt().Before(entries[oldest].updatedAt()) {
+				oldest = k
+			}
+		}
+		delete(entries, oldest)
+	}
+	s.scheduleSave()
+	return entry
+}
+
+// removeは値を消します。
+func (s *viewerStore[T]) remove(viewer string, key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.viewers[viewer][key]; !ok {
+		return
+	}
+	delete(s.viewers[viewer], key)
+	if len(s.viewers[viewer]) == 0 {
+		delete(s.viewers, viewer)
+	}
+	s.scheduleSave()
+}
+
+// recentは閲覧者の値を、新しい順のキーと一緒に返します。
+func (s *viewerStore[T]) recent(viewer string) ([]string, map[string]T) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make(map[string]T, len(s.viewers[viewer]))
+	var keys []string
+	for key, entry := range s.viewers[viewer] {
+		entries[key] = entry
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return entries[keys[i]].updatedAt().After(entries[keys[j]].updatedAt())
+	})
+	return keys, entries
+}
+
+// scheduleSaveは少し待ってからファイルに書き込みます。再生中やページをめくるたびに送られてくるので、まとめて書き込みます。
+// s.muをロックしてから呼び出してください。
+func (s *viewerStore[T]) scheduleSave() {
+	if s.saveTimer != nil {
+		return
+	}
+	s.saveTimer = time.AfterFunc(s.saveDelay, func() {
+		s.mu.Lock()
+		s.saveTimer = nil
+		content, err := json.Marshal(s.viewers)
+		s.mu.Unlock()
+		if err == nil {
+			err = writeFileAtomic(s.path, content)
+		}
+		if err != nil {
+			log.Printf("%s: 保存できません: '%s' %v", s.name, s.path, err)
+		}
+	})
+}
+
+// writeFileAtomicは一時ファイルに書いてから置き換えるので、途中で止まっても壊れたファイルが残りません。
+func writeFileAtomic(filePath string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}